@@ -1,13 +1,20 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
 
-	"github.com/raoulh/go-envoy/internal/envoy"
 	logger "github.com/raoulh/go-envoy/internal/log"
+	"github.com/raoulh/go-envoy/pkg/envoy"
 	"github.com/sirupsen/logrus"
 
 	"github.com/fatih/color"
@@ -33,6 +40,10 @@ var (
 	bgCyan     = color.New(color.FgWhite).SprintFunc()
 
 	verbose *bool
+	gateway *string
+
+	//cancelled on ctrl-c to abort running requests
+	ctx context.Context
 )
 
 func exit(err error, exit int) {
@@ -41,11 +52,18 @@ func exit(err error, exit int) {
 }
 
 func main() {
+	var cancel context.CancelFunc
+	ctx, cancel = signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
 	app := cli.App("envoy", "Envoy CLI App")
 
-	app.Spec = "[-v]"
+	app.Spec = "[-v] [-g=<gateway>]"
 
 	verbose = app.BoolOpt("v verbose", false, "Verbose debug mode")
+	gateway = app.StringOpt("g gateway", envoy.DefaultGateway, "Name of the gateway, each one has its own cache")
+
+	envoy.SetLogger(logger.NewLogger("envoy"))
 
 	app.Before = func() {
 		if *verbose {
@@ -67,11 +85,141 @@ func main() {
 			)
 
 			setCmd.Action = func() {
-				envoy.SetConfig(*host, *username, *password, *serial)
+				store, err := cacheStore()
+				if err != nil {
+					fmt.Println("Failed to open cache")
+					exit(err, 1)
+				}
+
+				//only the given settings are changed, the token and the
+				//pinned certificate are kept
+				var c envoy.Credentials
+				cached, err := store.Load()
+				if err != nil && !errors.Is(err, os.ErrNotExist) {
+					fmt.Println("Failed to read cache")
+					exit(err, 1)
+				}
+				if cached != nil {
+					c = *cached
+				}
+
+				if *serial != "" && c.Serial != "" && *serial != c.Serial {
+					//another gateway, its token and certificate are not the same
+					c.JWTToken = ""
+					c.TokenGeneratedAt = 0
+					c.TokenExpiry = 0
+					c.JWTExpiry = 0
+					c.CertFingerprint = ""
+				}
+				if *serial != "" {
+					c.Serial = *serial
+				}
+				if *username != "" {
+					c.Username = *username
+				}
+				if *password != "" {
+					c.Password = *password
+				}
+				if *host != "" {
+					c.Host = *host
+				}
+
+				if c.Host == "" {
+					g, err := discoverOne(c.Serial)
+					if err != nil {
+						fmt.Println("Failed to discover gateway, set its address with -h")
+						exit(err, 1)
+					}
+					c.Host = g.Host
+					if c.Serial == "" {
+						c.Serial = g.Serial
+					}
+					fmt.Println("Found envoy host:", c.Host)
+				}
+
+				err = store.Save(&c)
+				if err != nil {
+					fmt.Println("Failed to save config")
+					exit(err, 1)
+				}
+			}
+		})
+
+		config.Command("repin", "trust the current gateway certificate, after a firmware update", func(cmd *cli.Cmd) {
+			cmd.Action = func() {
+				store, err := cacheStore()
+				if err != nil {
+					fmt.Println("Failed to open cache")
+					exit(err, 1)
+				}
+
+				c, err := store.Load()
+				if err != nil {
+					fmt.Println("Failed to read cache")
+					exit(err, 1)
+				}
+				old := c.CertFingerprint
+				c.CertFingerprint = ""
+
+				if err = store.Save(c); err != nil {
+					fmt.Println("Failed to save config")
+					exit(err, 1)
+				}
+
+				//the certificate is pinned and saved by the first request
+				e, err := envoy.New(envoy.WithStore(store))
+				if err != nil {
+					exit(err, 1)
+				}
+				defer e.Close()
+
+				if _, err = e.Info(ctx); err != nil {
+					fmt.Println("Failed to connect to the gateway")
+					exit(err, 1)
+				}
+
+				fmt.Printf("Pinned gateway certificate %s\n", e.PinnedFingerprint())
+				if old != "" && old != e.PinnedFingerprint() {
+					fmt.Printf("Previous certificate was %s\n", old)
+				}
 			}
 		})
 	})
 
+	app.Command("discover", "find gateways on the local network", func(cmd *cli.Cmd) {
+		cmd.Spec = "[-t=<timeout>] [-j]"
+
+		var (
+			timeout = cmd.StringOpt("t timeout", envoy.DefaultDiscoverTimeout.String(), "How long to wait for answers")
+			j       = cmd.BoolOpt("j json", false, "Display raw json")
+		)
+
+		cmd.Action = func() {
+			t, err := time.ParseDuration(*timeout)
+			if err != nil {
+				fmt.Println("Invalid timeout")
+				exit(err, 1)
+			}
+
+			gateways, err := envoy.Discover(ctx, t)
+			if err != nil {
+				fmt.Println("Failed to discover gateways")
+				exit(err, 1)
+			}
+
+			if *j {
+				i, _ := json.MarshalIndent(gateways, "", " ")
+				fmt.Printf("%s\n", i)
+				return
+			}
+
+			for _, g := range gateways {
+				fmt.Printf("%s %s Serial: %s\tHost: %s:%d\tFirmware: %s\tProtocol: %s\n",
+					blue(CharArrow), CharElec, g.Serial, g.Host, g.Port, g.Firmware, g.ProtocolVersion)
+			}
+		}
+	})
+
 	app.Command("now", "display current production", func(cmd *cli.Cmd) {
 		cmd.Action = func() {
 			e, err := tryLogin()
@@ -81,12 +229,12 @@ func main() {
 			}
 			defer e.Close()
 
-			p, c, net, err := e.Now()
+			p, c, net, err := e.Now(ctx)
 			if err != nil {
 				fmt.Println("Failed to get current readings")
 				exit(err, 1)
 			}
-			max, err := e.SystemMax()
+			max, err := e.SystemMax(ctx)
 			if err != nil {
 				fmt.Printf("Failed to get system max prod: %v\n", err)
 			}
@@ -111,7 +259,7 @@ func main() {
 			}
 			defer e.Close()
 
-			p, c, net, err := e.Today()
+			p, c, net, err := e.Today(ctx)
 			if err != nil {
 				fmt.Println("Failed to get today readings")
 				exit(err, 1)
@@ -133,7 +281,7 @@ func main() {
 			}
 			defer e.Close()
 
-			s, err := e.Info()
+			s, err := e.Info(ctx)
 			if err != nil {
 				fmt.Println("Failed to get gateway info")
 				exit(err, 1)
@@ -159,7 +307,7 @@ func main() {
 			}
 			defer e.Close()
 
-			p, err := e.Production()
+			p, err := e.Production(ctx)
 			if err != nil {
 				fmt.Println("Failed to get prod info")
 				exit(err, 1)
@@ -179,7 +327,7 @@ func main() {
 			}
 			defer e.Close()
 
-			p, err := e.Inventory()
+			p, err := e.Inventory(ctx)
 			if err != nil {
 				fmt.Println("Failed to get prod info")
 				exit(err, 1)
@@ -190,7 +338,19 @@ func main() {
 		}
 	})
 
-	app.Command("inverters", "display raw json inverters", func(cmd *cli.Cmd) {
+	app.Command("inverters", "display inverters as raw json or a report", func(cmd *cli.Cmd) {
+		cmd.Spec = "[-r] [-m=<ratio>] [-d=<url>]"
+
+		var (
+			report   = cmd.BoolOpt("r report", false, "Display a table joined with the inventory")
+			minRatio = cmd.StringOpt("m min-ratio", "0.8", "Flag inverters whose last report is less than this ratio of the median")
+			daemon   = cmd.String(cli.StringOpt{
+				Name:   "d daemon",
+				Desc:   "URL of the envoy daemon, the inverters underperforming for days are read from its history",
+				EnvVar: "ENVOY_DAEMON_URL",
+			})
+		)
+
 		cmd.Action = func() {
 			e, err := tryLogin()
 			if err != nil {
@@ -199,14 +359,39 @@ func main() {
 			}
 			defer e.Close()
 
-			p, err := e.Inverters()
+			p, err := e.Inverters(ctx)
 			if err != nil {
 				fmt.Println("Failed to get prod info")
 				exit(err, 1)
 			}
 
-			i, _ := json.MarshalIndent(p, "", " ")
-			fmt.Printf("%s\n", i)
+			if !*report {
+				i, _ := json.MarshalIndent(p, "", " ")
+				fmt.Printf("%s\n", i)
+				return
+			}
+
+			ratio, err := strconv.ParseFloat(*minRatio, 64)
+			if err != nil {
+				exit(fmt.Errorf("invalid min ratio: %w", err), 1)
+			}
+
+			inv, err := e.Inventory(ctx)
+			if err != nil {
+				fmt.Println("Failed to get inventory info")
+				exit(err, 1)
+			}
+
+			var flags map[string]inverterFlag
+			if *daemon != "" {
+				flags, err = daemonInverterFlags(*daemon)
+				if err != nil {
+					fmt.Println("Failed to get daily flags from the daemon")
+					exit(err, 1)
+				}
+			}
+
+			printInvertersReport(envoy.JoinInverters(*p, *inv), ratio, flags)
 		}
 	})
 
@@ -219,7 +404,7 @@ func main() {
 			}
 			defer e.Close()
 
-			p, err := e.Home()
+			p, err := e.Home(ctx)
 			if err != nil {
 				fmt.Println("Failed to get prod info")
 				exit(err, 1)
@@ -230,47 +415,316 @@ func main() {
 		}
 	})
 
+	app.Command("battery", "display IQ Batteries and Enpower state", func(cmd *cli.Cmd) {
+		cmd.Spec = "[-j]"
+
+		var j = cmd.BoolOpt("j json", false, "JSON output mode")
+
+		cmd.Action = func() {
+			s, err := tryLogin()
+			if err != nil {
+				fmt.Println("Failed to login")
+				exit(err, 1)
+			}
+			defer s.Close()
+
+			b, err := s.Battery(ctx)
+			if err != nil {
+				fmt.Println("Failed to get battery info")
+				exit(err, 1)
+			}
+
+			if *j {
+				i, _ := json.MarshalIndent(b, "", " ")
+				fmt.Printf("%s\n", i)
+				return
+			}
+
+			if len(b.Batteries) == 0 && b.Enpower == nil {
+				fmt.Println("No battery found")
+				return
+			}
+
+			grid := green("on-grid")
+			if !b.OnGrid {
+				grid = errorRed("off-grid")
+			}
+			fmt.Printf(CharElec+cyan("Battery:")+" %.0f%%\t%.0f/%.0fWh\t"+cyan("Power:")+" %s\t"+cyan("Grid:")+" %s %s\n",
+				b.Soc, b.AvailableEnergyWh, b.MaxEnergyWh, batteryPower(b.PowerW), grid, b.GridMode)
+
+			for _, bat := range b.Batteries {
+				state := green(CharCheck)
+				if !bat.Communicating || !bat.Operating {
+					state = errorRed(CharAbort)
+				}
+				fmt.Printf("%s %s %s\t%5.1f%%\t%s\t%.0fC\t%s\n",
+					blue(CharArrow), state, bat.Serial, bat.Soc, batteryPower(bat.PowerW), bat.Temperature, bat.Status)
+			}
+
+			if p := b.Enpower; p != nil {
+				state := green(CharCheck)
+				if !p.Communicating {
+					state = errorRed(CharAbort)
+				}
+				fmt.Printf("%s %s Enpower %s\trelay: %s\t%.0fC\n",
+					blue(CharArrow), state, p.Serial, p.MainsOperState, p.Temperature)
+			}
+		}
+	})
+
+	app.Command("meters", "display CT meters and their readings", func(cmd *cli.Cmd) {
+		cmd.Spec = "[-j]"
+
+		var j = cmd.BoolOpt("j json", false, "JSON output mode")
+
+		cmd.Action = func() {
+			s, err := tryLogin()
+			if err != nil {
+				fmt.Println("Failed to login")
+				exit(err, 1)
+			}
+			defer s.Close()
+
+			meters, err := s.Meters(ctx)
+			if err != nil {
+				fmt.Println("Failed to get meters")
+				exit(err, 1)
+			}
+			readings, err := s.MeterReadings(ctx)
+			if err != nil {
+				fmt.Println("Failed to get meter readings")
+				exit(err, 1)
+			}
+
+			if *j {
+				i, _ := json.MarshalIndent(map[string]interface{}{
+					"meters":   meters,
+					"readings": readings,
+				}, "", " ")
+				fmt.Printf("%s\n", i)
+				return
+			}
+
+			if len(*meters) == 0 {
+				fmt.Println("No meter found")
+				return
+			}
+
+			for _, m := range *meters {
+				state := green(CharCheck)
+				if m.State != "enabled" {
+					state = errorRed(CharAbort)
+				}
+				fmt.Printf("%s %s %s\teid: %d\t%s, %d phases\t%s\n",
+					blue(CharArrow), state, cyan(m.MeasurementType), m.EID, m.PhaseMode, m.PhaseCount, m.MeteringStatus)
+
+				for _, r := range *readings {
+					if r.EID != m.EID {
+						continue
+					}
+					fmt.Printf("   %s %8.1fW %7.1fV %6.2fA %5.2fHz\t%8.1fVAR %8.1fVA\t"+cyan("Import:")+" %.3fkWh\t"+cyan("Export:")+" %.3fkWh\n",
+						CharVertLine, r.ActivePower, r.Voltage, r.Current, r.Freq, r.ReactivePower, r.ApparentPower,
+						r.ActEnergyDlvd/1000, r.ActEnergyRcvd/1000)
+					for n, c := range r.Channels {
+						fmt.Printf("   %s L%d %8.1fW %7.1fV %6.2fA\n", CharVertLine, n+1, c.ActivePower, c.Voltage, c.Current)
+					}
+				}
+			}
+		}
+	})
+
+	app.Command("stream", "display live meter readings", func(cmd *cli.Cmd) {
+		cmd.Spec = "[-j]"
+
+		var j = cmd.BoolOpt("j json", false, "JSON output mode")
+
+		cmd.Action = func() {
+			s, err := tryLogin()
+			if err != nil {
+				fmt.Println("Failed to login")
+				exit(err, 1)
+			}
+			defer s.Close()
+
+			samples, err := s.StreamMeter(ctx)
+			if err != nil {
+				fmt.Println("Failed to open meter stream")
+				exit(err, 1)
+			}
+
+			for m := range samples {
+				if *j {
+					i, _ := json.Marshal(m)
+					fmt.Printf("%s\n", i)
+					continue
+				}
+
+				net := fmt.Sprintf("%7.1fW", m.NetConsumption.Power())
+				if m.NetConsumption.Power() > 0 {
+					net = errorRed(net)
+				} else {
+					net = green(net)
+				}
+
+				fmt.Printf(CharElec+cyan("Production:")+" %7.1fW [%6.1f %6.1f %6.1f]\t"+cyan("Consumption:")+" %7.1fW [%6.1f %6.1f %6.1f]\tNet import: %s\n",
+					m.Production.Power(), m.Production.A.P, m.Production.B.P, m.Production.C.P,
+					m.TotalConsumption.Power(), m.TotalConsumption.A.P, m.TotalConsumption.B.P, m.TotalConsumption.C.P,
+					net)
+			}
+		}
+	})
+
 	if err := app.Run(os.Args); err != nil {
 		exit(err, 1)
 	}
 
 }
 
-func tryLogin() (e *envoy.Envoy, err error) {
-	e = envoy.New()
+// inverterFlag is the daily performance of an inverter from the daemon
+type inverterFlag struct {
+	SerialNumber        string `json:"serialNumber"`
+	UnderperformingDays int    `json:"underperforming_days"`
+	Flagged             bool   `json:"flagged"`
+}
 
-	//No token yet, try to login
-	if e.JWTToken == "" {
-		err = e.Login()
-		if err != nil {
-			return
+// daemonInverterFlags reads the daily flags of the inverters from
+// /api/inverters of the daemon, they are computed from its history
+func daemonInverterFlags(url string) (map[string]inverterFlag, error) {
+	u := strings.TrimSuffix(url, "/") + "/api"
+	if *gateway != envoy.DefaultGateway {
+		u += "/" + *gateway
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u+"/inverters", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("daemon returned %s", resp.Status)
+	}
+
+	var inv []inverterFlag
+	if err = json.NewDecoder(resp.Body).Decode(&inv); err != nil {
+		return nil, err
+	}
+
+	flags := make(map[string]inverterFlag, len(inv))
+	for _, i := range inv {
+		flags[i.SerialNumber] = i
+	}
+	return flags, nil
+}
+
+// printInvertersReport displays the inverters with the performance of their
+// last report relative to the median, those below ratio or not working are
+// flagged. The performance is not rated at night, when the median is 0. With
+// the flags of the daemon, the inverters underperforming for days are
+// flagged too.
+func printInvertersReport(inverters []envoy.InverterStatus, ratio float64, flags map[string]inverterFlag) {
+	watts := make([]float64, 0, len(inverters))
+	for _, i := range inverters {
+		watts = append(watts, float64(i.LastReportWatts))
+	}
+	median := envoy.Median(watts)
+
+	fmt.Printf("  %-14s %6s %6s %6s %4s  %-9s %-13s %-19s %s\n",
+		"Serial", "W", "Max W", "Perf", "Days", "Producing", "Communicating", "Last report", "Status")
+
+	flagged := 0
+	for _, i := range inverters {
+		days := "-"
+		f, ok := flags[i.SerialNumber]
+		if ok {
+			days = strconv.Itoa(f.UnderperformingDays)
 		}
 
-		err = e.GetToken()
-		if err != nil {
-			return
+		state := green(CharCheck)
+		if !i.Producing || !i.Communicating || (median > 0 && i.Performance < ratio) || f.Flagged {
+			state = errorRed(CharWarning)
+			flagged++
 		}
+
+		fmt.Printf("%s %-14s %6d %6d %5.0f%% %4s  %-9t %-13t %-19s %s\n",
+			state, i.SerialNumber, i.LastReportWatts, i.MaxReportWatts, i.Performance*100, days,
+			i.Producing, i.Communicating,
+			time.Unix(int64(i.LastReportDate), 0).Format("2006-01-02 15:04:05"),
+			strings.Join(i.DeviceStatus, ","))
 	}
 
-	//Try to get the local cookie
-	err = e.GetLocalSessionCookie()
+	if median > 0 {
+		fmt.Printf("%d inverters, %d flagged, performance of the last report (median %.0fW)\n", len(inverters), flagged, median)
+	} else {
+		fmt.Printf("%d inverters, %d flagged, performance not rated: no production\n", len(inverters), flagged)
+	}
+	if flags == nil {
+		fmt.Println("underperforming days are read from the daemon history, see --daemon")
+	}
+}
+
+// batteryPower formats the power of a battery, positive when discharging
+func batteryPower(w float64) string {
+	switch {
+	case w > 0:
+		return fmt.Sprintf("%.0fW discharging", w)
+	case w < 0:
+		return fmt.Sprintf("%.0fW charging", -w)
+	default:
+		return "idle"
+	}
+}
+
+// cacheStore returns the store for credentials and token of the selected
+// gateway. ENVOY_STORE_TYPE and ENVOY_STORE_PASSPHRASE select the store like
+// store.type and store.passphrase do for the daemon.
+func cacheStore() (envoy.CredentialStore, error) {
+	return envoy.NewCacheStore(*gateway, "",
+		os.Getenv("ENVOY_STORE_TYPE"),
+		os.Getenv("ENVOY_STORE_PASSPHRASE"))
+}
+
+// discoverOne returns the gateway with the given serial, or the only one found
+// on the network if serial is empty
+func discoverOne(serial string) (*envoy.DiscoveredGateway, error) {
+	gateways, err := envoy.Discover(ctx, 0)
 	if err != nil {
-		//The cookie is not valid anymore, login again
-		err = e.Login()
-		if err != nil {
-			return
-		}
+		return nil, err
+	}
 
-		err = e.GetToken()
-		if err != nil {
-			return
+	if serial == "" {
+		if len(gateways) > 1 {
+			return nil, fmt.Errorf("%d gateways found, set the serial with -s or use envoy discover", len(gateways))
 		}
+		return &gateways[0], nil
+	}
 
-		err = e.GetLocalSessionCookie()
-		if err != nil {
-			return
+	for i := range gateways {
+		if gateways[i].Serial == serial {
+			return &gateways[i], nil
 		}
 	}
+	return nil, envoy.ErrGatewayNotFound
+}
+
+// tryLogin opens a session on the selected gateway. Requests done through it
+// renew the session and look for the gateway on the network if needed.
+func tryLogin() (s *envoy.Session, err error) {
+	store, err := cacheStore()
+	if err != nil {
+		return
+	}
+
+	e, err := envoy.New(envoy.WithStore(store))
+	if err != nil {
+		return
+	}
 
+	s = envoy.NewSession(e)
+	err = s.Authenticate(ctx)
 	return
 }
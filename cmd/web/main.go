@@ -12,6 +12,7 @@ import (
 	"github.com/raoulh/go-envoy/internal/app"
 	"github.com/raoulh/go-envoy/internal/config"
 	"github.com/raoulh/go-envoy/internal/models"
+	"github.com/raoulh/go-envoy/pkg/envoy"
 
 	logger "github.com/raoulh/go-envoy/internal/log"
 
@@ -61,6 +62,7 @@ func handleSignals() {
 
 func main() {
 	logging = logger.NewLogger("envoy")
+	envoy.SetLogger(logging)
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
 	a := cli.App("envoy", "Envoy Web App")
@@ -2,10 +2,12 @@ module github.com/raoulh/go-envoy
 
 require (
 	github.com/brutella/dnssd v1.2.3
+	github.com/eclipse/paho.mqtt.golang v1.4.2
 	github.com/fatih/color v1.13.0
 	github.com/fsnotify/fsnotify v1.5.4 // indirect
 	github.com/gofiber/fiber/v2 v2.40.1
-	github.com/gofiber/template v1.7.3 // indirect
+	github.com/gofiber/template v1.7.3
+	github.com/gofiber/websocket/v2 v2.1.2
 	github.com/jawher/mow.cli v1.2.0
 	github.com/klauspost/compress v1.15.13 // indirect
 	github.com/knadh/koanf v1.4.3
@@ -14,9 +16,11 @@ require (
 	github.com/pelletier/go-toml v1.9.5 // indirect
 	github.com/rivo/uniseg v0.4.3 // indirect
 	github.com/sirupsen/logrus v1.9.0
-	github.com/valyala/fasthttp v1.43.0 // indirect
+	github.com/valyala/fasthttp v1.43.0
 	github.com/xinsnake/go-http-digest-auth-client v0.6.0
-	golang.org/x/net v0.0.0-20220906165146-f3363e06e74c // indirect
+	go.etcd.io/bbolt v1.3.6
+	golang.org/x/crypto v0.0.0-20220214200702-86341886e292
+	golang.org/x/net v0.0.0-20220906165146-f3363e06e74c
 	golang.org/x/sys v0.3.0 // indirect
 	golang.org/x/tools v0.1.11 // indirect
 	golang.org/x/xerrors v0.0.0-20220609144429-65e65417b02f // indirect
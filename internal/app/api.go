@@ -1,15 +1,169 @@
 package app
 
-import "github.com/gofiber/fiber/v2"
+import (
+	"net/http"
+	"strconv"
+	"time"
 
-func (a *AppServer) apiProduction(c *fiber.Ctx) error {
-	return c.JSON(production)
+	"github.com/gofiber/fiber/v2"
+	"github.com/raoulh/go-envoy/internal/config"
+	"github.com/raoulh/go-envoy/pkg/envoy"
+)
+
+type staleResponse struct {
+	Error      string     `json:"error"`
+	FetchedAt  *time.Time `json:"fetched_at,omitempty"`
+	AgeSeconds float64    `json:"age_seconds,omitempty"`
+	LastError  string     `json:"last_error,omitempty"`
+}
+
+// maxDataAge returns the age after which data is not served anymore, it is
+// at least twice the poll interval of the dataset
+func (s *site) maxDataAge(dataset string) time.Duration {
+	return s.maxAge(dataset, config.Config.Duration("general.max_data_age"))
+}
+
+// setDataHeaders tells the client when the data was fetched from the gateway
+// and if the last fetch failed
+func setDataHeaders(c *fiber.Ctx, info *datasetInfo, now time.Time) {
+	c.Set("X-Data-Version", strconv.FormatUint(info.Version, 10))
+	if !info.FetchedAt.IsZero() {
+		c.Set("X-Fetched-At", info.FetchedAt.Format(time.RFC3339))
+		c.Set("X-Data-Age", strconv.FormatFloat(info.age(now).Seconds(), 'f', 0, 64))
+		c.Set(fiber.HeaderLastModified, info.FetchedAt.UTC().Format(http.TimeFormat))
+	}
+	if info.failing() {
+		c.Set("X-Last-Error", info.LastError)
+	}
+}
+
+// sendDataset sends the data as json, or a 503 error when it is too old
+func (s *site) sendDataset(c *fiber.Ctx, dataset string, info datasetInfo, v interface{}) error {
+	now := time.Now()
+	setDataHeaders(c, &info, now)
+
+	if info.stale(now, s.maxDataAge(dataset)) {
+		r := staleResponse{
+			Error:     "data is not available",
+			LastError: info.LastError,
+		}
+		if !info.FetchedAt.IsZero() {
+			r.Error = "data is stale"
+			r.FetchedAt = &info.FetchedAt
+			r.AgeSeconds = info.age(now).Seconds()
+		}
+		return c.Status(fiber.StatusServiceUnavailable).JSON(r)
+	}
+
+	return c.JSON(v)
+}
+
+func apiProduction(c *fiber.Ctx, s *site) error {
+	p, info := s.production()
+	return s.sendDataset(c, datasetProduction, info, p)
+}
+
+func apiInventory(c *fiber.Ctx, s *site) error {
+	inv, info := s.data.getInventory()
+	return s.sendDataset(c, datasetInventory, info, inv)
+}
+
+func apiBattery(c *fiber.Ctx, s *site) error {
+	b, info := s.data.getBattery()
+	return s.sendDataset(c, datasetBattery, info, b)
 }
 
-func (a *AppServer) apiInventory(c *fiber.Ctx) error {
-	return c.JSON(inventory)
+func apiMeters(c *fiber.Ctx, s *site) error {
+	m, info := s.data.getMeters()
+	return s.sendDataset(c, datasetMeters, info, m)
 }
 
-func (a *AppServer) apiInverters(c *fiber.Ctx) error {
-	return c.JSON(inverters)
+func apiLiveData(c *fiber.Ctx, s *site) error {
+	d, info := s.data.getLiveData()
+	return s.sendDataset(c, datasetLiveData, info, d)
+}
+
+// siteTotals are the main values of a gateway, in W and Wh
+type siteTotals struct {
+	ProductionW        float64 `json:"production_w"`
+	ConsumptionW       float64 `json:"consumption_w"`
+	NetW               float64 `json:"net_w"`
+	ProductionTodayWh  float64 `json:"production_today_wh"`
+	ConsumptionTodayWh float64 `json:"consumption_today_wh"`
+	NetTodayWh         float64 `json:"net_today_wh"`
+}
+
+func newSiteTotals(p *envoy.Production) (t siteTotals) {
+	if e := p.ProductionEntry(); e != nil {
+		t.ProductionW = e.WNow
+		t.ProductionTodayWh = e.WhToday
+	}
+	if e := p.TotalConsumption(); e != nil {
+		t.ConsumptionW = e.WNow
+		t.ConsumptionTodayWh = e.WhToday
+	}
+	if e := p.NetConsumption(); e != nil {
+		t.NetW = e.WNow
+		t.NetTodayWh = e.WhToday
+	}
+	return
+}
+
+func (t *siteTotals) add(o *siteTotals) {
+	t.ProductionW += o.ProductionW
+	t.ConsumptionW += o.ConsumptionW
+	t.NetW += o.NetW
+	t.ProductionTodayWh += o.ProductionTodayWh
+	t.ConsumptionTodayWh += o.ConsumptionTodayWh
+	t.NetTodayWh += o.NetTodayWh
+}
+
+type siteSummary struct {
+	Gateway   string     `json:"gateway"`
+	Totals    siteTotals `json:"totals"`
+	FetchedAt *time.Time `json:"fetched_at,omitempty"`
+	Stale     bool       `json:"stale"`
+	LastError string     `json:"last_error,omitempty"`
+}
+
+type allSitesResponse struct {
+	Total siteTotals `json:"total"`
+	// Complete is false if the data of a gateway is stale, it is not in the
+	// total
+	Complete bool          `json:"complete"`
+	Sites    []siteSummary `json:"sites"`
+}
+
+// apiAllSites sums the production and consumption of all gateways
+func (a *AppServer) apiAllSites(c *fiber.Ctx) error {
+	now := time.Now()
+	r := allSitesResponse{
+		Complete: true,
+		Sites:    make([]siteSummary, 0, len(a.sites)),
+	}
+
+	for _, s := range a.sites {
+		p, info := s.production()
+
+		sum := siteSummary{
+			Gateway: s.name,
+			Totals:  newSiteTotals(&p),
+			Stale:   info.stale(now, s.maxDataAge(datasetProduction)),
+		}
+		if !info.FetchedAt.IsZero() {
+			sum.FetchedAt = &info.FetchedAt
+		}
+		if info.failing() {
+			sum.LastError = info.LastError
+		}
+
+		if sum.Stale {
+			r.Complete = false
+		} else {
+			r.Total.add(&sum.Totals)
+		}
+		r.Sites = append(r.Sites, sum)
+	}
+
+	return c.JSON(r)
 }
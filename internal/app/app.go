@@ -1,6 +1,9 @@
 package app
 
 import (
+	"context"
+	"fmt"
+	"net"
 	"strconv"
 	"sync"
 	"time"
@@ -8,22 +11,30 @@ import (
 	"github.com/gofiber/fiber/v2"
 	fiberLog "github.com/gofiber/fiber/v2/middleware/logger"
 	"github.com/gofiber/template/html"
+	"github.com/gofiber/websocket/v2"
 
 	"github.com/raoulh/go-envoy/internal/config"
 	logger "github.com/raoulh/go-envoy/internal/log"
+	"github.com/raoulh/go-envoy/internal/systemd"
 	"github.com/sirupsen/logrus"
 )
 
 const (
-	maxFileSize  = 1 * 1024 * 1024 * 1024
-	dataWaitTime = time.Second * 1
+	maxFileSize     = 1 * 1024 * 1024 * 1024
+	dataReadTimeout = time.Second * 10
 )
 
 type AppServer struct {
-	quitHeartbeat chan interface{}
-	wgDone        sync.WaitGroup
+	ctx    context.Context
+	cancel context.CancelFunc
+	wgDone sync.WaitGroup
+
+	startedAt time.Time
 
 	appFiber *fiber.App
+
+	sites  []*site
+	events *eventHub
 }
 
 var logging *logrus.Entry
@@ -38,8 +49,13 @@ func NewApp() (a *AppServer, err error) {
 
 	engine := html.New(config.Config.String("general.static")+"/templates", ".html")
 
+	names, err := siteNames()
+	if err != nil {
+		return
+	}
+
 	a = &AppServer{
-		quitHeartbeat: make(chan interface{}),
+		events: newEventHub(),
 		appFiber: fiber.New(fiber.Config{
 			ServerHeader:          "Envoy (Linux)",
 			ReadTimeout:           time.Second * 20,
@@ -51,6 +67,16 @@ func NewApp() (a *AppServer, err error) {
 		}),
 	}
 
+	a.ctx, a.cancel = context.WithCancel(context.Background())
+
+	for _, name := range names {
+		s, err := a.newSite(name, len(names) > 1)
+		if err != nil {
+			return nil, fmt.Errorf("gateway %s: %w", name, err)
+		}
+		a.sites = append(a.sites, s)
+	}
+
 	a.appFiber.
 		Use(fiberLog.New(fiberLog.Config{}))
 
@@ -66,17 +92,55 @@ func NewApp() (a *AppServer, err error) {
 		return a.homePage(c)
 	})
 
+	a.appFiber.Get("/healthz", func(c *fiber.Ctx) error {
+		return a.apiHealthz(c)
+	})
+	a.appFiber.Get("/readyz", func(c *fiber.Ctx) error {
+		return a.apiReadyz(c)
+	})
+
+	a.appFiber.Get("/metrics", func(c *fiber.Ctx) error {
+		return a.apiMetrics(c)
+	})
+
 	//API
 	api := a.appFiber.Group("/api")
-	api.Get("/production", func(c *fiber.Ctx) error {
-		return a.apiProduction(c)
+	api.Get("/"+siteAll, func(c *fiber.Ctx) error {
+		return a.apiAllSites(c)
 	})
-	api.Get("/inventory", func(c *fiber.Ctx) error {
-		return a.apiInventory(c)
+	api.Get("/history", func(c *fiber.Ctx) error {
+		return a.apiHistory(c)
 	})
-	api.Get("/inverters", func(c *fiber.Ctx) error {
-		return a.apiInverters(c)
+	api.Get("/events", func(c *fiber.Ctx) error {
+		return a.apiEvents(c)
 	})
+	api.Use("/ws", func(c *fiber.Ctx) error {
+		if !websocket.IsWebSocketUpgrade(c) {
+			return fiber.ErrUpgradeRequired
+		}
+		gateway, err := a.eventsGateway(c)
+		if err != nil {
+			return err
+		}
+		c.Locals("gateway", gateway)
+		return c.Next()
+	})
+	api.Get("/ws", websocket.New(func(conn *websocket.Conn) {
+		gateway, _ := conn.Locals("gateway").(string)
+		a.apiWebsocket(conn, gateway)
+	}))
+
+	//The routes without gateway serve the primary one
+	for _, prefix := range []string{"", "/:gateway"} {
+		api.Get(prefix+"/production", a.siteHandler(apiProduction))
+		api.Get(prefix+"/inventory", a.siteHandler(apiInventory))
+		api.Get(prefix+"/inverters", a.siteHandler(apiInverters))
+		api.Get(prefix+"/inverters/:serial/history", a.siteHandler(apiInverterHistory))
+		api.Get(prefix+"/battery", a.siteHandler(apiBattery))
+		api.Get(prefix+"/meters", a.siteHandler(apiMeters))
+		api.Get(prefix+"/livedata", a.siteHandler(apiLiveData))
+		api.Get(prefix+"/status", a.siteHandler(apiStatus))
+	}
 
 	return
 }
@@ -87,34 +151,46 @@ func (a *AppServer) Start() {
 
 	logging.Infoln("\u21D2 Server listening on", addr)
 
+	a.startedAt = time.Now()
+
+	//listen first, the daemon is ready for systemd once it serves http
+	ln, err := net.Listen(a.appFiber.Config().Network, addr)
+	if err != nil {
+		logging.Fatalf("Failed to listen http server: %v", err)
+	}
+
 	go func() {
-		if err := a.appFiber.Listen(addr); err != nil {
+		if err := a.appFiber.Listener(ln); err != nil {
 			logging.Fatalf("Failed to listen http server: %v", err)
 		}
 	}()
 	a.wgDone.Add(1)
 
-	go a.getDataFromGateway()
-	a.wgDone.Add(1)
+	for _, s := range a.sites {
+		go s.getDataFromGateway()
+		a.wgDone.Add(1)
+
+		s.gateway.StartTokenRefresh(a.ctx)
+	}
+
+	if config.Config.Bool("health.sd_notify") && systemd.Enabled() {
+		go a.runNotify()
+		a.wgDone.Add(1)
+	}
 }
 
 // Stop the app
 func (a *AppServer) Shutdown() {
-	close(a.quitHeartbeat)
+	a.cancel()
 	a.appFiber.Shutdown()
 	a.wgDone.Wait()
-}
 
-func (a *AppServer) getDataFromGateway() {
-	defer a.wgDone.Done()
+	for _, s := range a.sites {
+		s.gateway.StopTokenRefresh()
+		s.gateway.Close()
 
-	for {
-		select {
-		case <-a.quitHeartbeat:
-			logging.Debugln("exiting data gather routine")
-			return
-		case <-time.After(dataWaitTime):
-			a.doDataRead()
+		if s.mqtt != nil {
+			s.mqtt.close()
 		}
 	}
 }
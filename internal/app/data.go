@@ -1,80 +1,257 @@
 package app
 
 import (
-	"github.com/raoulh/go-envoy/internal/envoy"
-)
+	"context"
+	"errors"
+	"sync"
+	"time"
 
-var (
-	production envoy.Production
-	inventory  []envoy.Inventory
-	inverters  []envoy.Inverter
+	"github.com/raoulh/go-envoy/internal/config"
+	"github.com/raoulh/go-envoy/internal/models"
+	"github.com/raoulh/go-envoy/pkg/envoy"
 )
 
-func (a *AppServer) doDataRead() {
-	e, err := tryLogin()
+func (s *site) fetchProduction(ctx context.Context) error {
+	prod, err := s.session.Production(ctx)
 	if err != nil {
-		logging.Error("Failed to login")
-		return
+		s.logger().Error("Failed to get prod info")
+		s.data.setError(datasetProduction, err)
+		return err
+	}
+
+	s.data.setProduction(*prod)
+
+	p, _ := s.production()
+	s.publishProduction(&p)
+
+	return nil
+}
+
+// production returns the last production read, with the power of the live
+// data when it is streaming
+func (s *site) production() (envoy.Production, datasetInfo) {
+	prod, info := s.data.getProduction()
+	if info.FetchedAt.IsZero() || !s.liveDataActive() {
+		return prod, info
+	}
+
+	d, _ := s.data.getLiveData()
+	return withLivePower(prod, &d), info
+}
+
+// publishProduction sends the production to the events clients, MQTT and
+// the history, at the production poll interval
+func (s *site) publishProduction(prod *envoy.Production) {
+	s.app.events.publish(s.name, datasetProduction, prod)
+
+	//inverters report every 5 minutes, use the last known values
+	inverters, _ := s.data.getInverters()
+
+	if s.mqtt != nil {
+		s.mqtt.publish(prod, inverters)
+	}
+
+	s.history.record(s.historySite(), prod, inverters)
+}
+
+func (s *site) fetchInventory(ctx context.Context) error {
+	inv, err := s.session.Inventory(ctx)
+	if err != nil {
+		s.logger().Error("Failed to get inventory info")
+		s.data.setError(datasetInventory, err)
+		return err
+	}
+
+	s.data.setInventory(*inv)
+	s.app.events.publish(s.name, datasetInventory, inv)
+
+	return nil
+}
+
+func (s *site) fetchInverters(ctx context.Context) error {
+	inver, err := s.session.Inverters(ctx)
+	if err != nil {
+		s.logger().Error("Failed to get inverters info")
+		s.data.setError(datasetInverters, err)
+		return err
 	}
-	defer e.Close()
 
-	prod, err := e.Production()
+	s.data.setInverters(*inver)
+	s.app.events.publish(s.name, datasetInverters, inver)
+
+	return nil
+}
+
+func (s *site) fetchBattery(ctx context.Context) error {
+	b, err := s.session.Battery(ctx)
 	if err != nil {
-		logging.Error("Failed to get prod info")
-	} else {
-		production = *prod
+		s.logger().Error("Failed to get battery info")
+		s.data.setError(datasetBattery, err)
+		return err
 	}
 
-	inv, err := e.Inventory()
+	s.data.setBattery(*b)
+	s.app.events.publish(s.name, datasetBattery, b)
+
+	return nil
+}
+
+func (s *site) fetchMeters(ctx context.Context) error {
+	meters, err := s.session.Meters(ctx)
+	var readings *[]envoy.MeterReading
+	if err == nil {
+		readings, err = s.session.MeterReadings(ctx)
+	}
 	if err != nil {
-		logging.Error("Failed to get inventory info")
-	} else {
-		inventory = *inv
+		s.logger().Error("Failed to get meters info")
+		s.data.setError(datasetMeters, err)
+		return err
 	}
 
-	inver, err := e.Inverters()
+	m := meterData{Meters: *meters, Readings: *readings}
+	s.data.setMeters(m)
+	s.app.events.publish(s.name, datasetMeters, m)
+
+	return nil
+}
+
+// fetchLiveData reads the live data, it has its own events. Its power is used
+// for the production when it is read, see production. The production itself
+// is then read less often for the energies.
+func (s *site) fetchLiveData(ctx context.Context) error {
+	d, err := s.session.LiveData(ctx)
 	if err != nil {
-		logging.Error("Failed to get inverters info")
-	} else {
-		inverters = *inver
+		if !errors.Is(err, envoy.ErrNotSupported) {
+			s.logger().Error("Failed to get live data")
+		}
+		s.data.setError(datasetLiveData, err)
+		return err
 	}
+
+	s.data.setLiveData(*d)
+	s.app.events.publish(s.name, datasetLiveData, d)
+
+	return nil
+}
+
+// liveDataActive returns true while the live data is read successfully and
+// streaming, its power is then the one of the production
+func (s *site) liveDataActive() bool {
+	d, info := s.data.getLiveData()
+	return d.Streaming() && !info.failing() &&
+		!info.stale(time.Now(), 3*s.pollInterval(datasetLiveData))
 }
 
-func tryLogin() (e *envoy.Envoy, err error) {
-	e = envoy.New()
+// withLivePower returns a copy of the production with the power of the meters
+// taken from the live data
+func withLivePower(p envoy.Production, d *envoy.LiveData) envoy.Production {
+	p.Production = livePowerEntries(p.Production, map[string]*envoy.LiveDataPower{
+		"production": &d.Meters.Pv,
+	})
+	p.Consumption = livePowerEntries(p.Consumption, map[string]*envoy.LiveDataPower{
+		"total-consumption": &d.Meters.Load,
+		"net-consumption":   &d.Meters.Grid,
+	})
+	return p
+}
+
+// livePowerEntries copies the entries and sets the power of those listed in
+// power, the snapshot is never modified in place
+func livePowerEntries(entries []envoy.Entry, power map[string]*envoy.LiveDataPower) []envoy.Entry {
+	out := make([]envoy.Entry, len(entries))
+	copy(out, entries)
 
-	//No token yet, try to login
-	if e.JWTToken == "" {
-		err = e.Login()
-		if err != nil {
-			return
+	for i := range out {
+		pw, ok := power[out[i].MeasurementType]
+		if !ok {
+			continue
 		}
 
-		err = e.GetToken()
-		if err != nil {
-			return
+		out[i].WNow = pw.Power()
+
+		phases := pw.PhasePower()
+		lines := make([]envoy.Line, len(out[i].Lines))
+		copy(lines, out[i].Lines)
+		for l := range lines {
+			if l < len(phases) {
+				lines[l].WNow = phases[l]
+			}
 		}
+		out[i].Lines = lines
 	}
 
-	//Try to get the local cookie
-	err = e.GetLocalSessionCookie()
-	if err != nil {
-		//The cookie is not valid anymore, login again
-		err = e.Login()
-		if err != nil {
-			return
+	return out
+}
+
+// producing returns false when the last production read is zero, that is at
+// night
+func (s *site) producing() bool {
+	prod, info := s.production()
+	if info.FetchedAt.IsZero() {
+		return true
+	}
+	if e := prod.ProductionEntry(); e != nil {
+		return e.WNow > 0
+	}
+	return true
+}
+
+// historyRecorder selects what is written in the history of a site: the
+// power at most every history.sample_interval and each inverter only when it
+// reported a new value
+type historyRecorder struct {
+	mu        sync.Mutex
+	lastPower time.Time
+	reports   map[string]uint64
+}
+
+func (h *historyRecorder) record(site string, prod *envoy.Production, inv []envoy.Inverter) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s := models.Sample{
+		Site:      site,
+		Time:      time.Now(),
+		Inverters: make(map[string]float64),
+	}
+
+	if s.Time.Sub(h.lastPower) >= config.Config.Duration("history.sample_interval") {
+		s.HasPower = true
+		h.lastPower = s.Time
+
+		if e := prod.ProductionEntry(); e != nil {
+			s.Production = e.WNow
 		}
+		if e := prod.TotalConsumption(); e != nil {
+			s.Consumption = e.WNow
+		}
+		if e := prod.NetConsumption(); e != nil {
+			s.Net = e.WNow
+		}
+	}
 
-		err = e.GetToken()
-		if err != nil {
-			return
+	if h.reports == nil {
+		h.reports = make(map[string]uint64, len(inv))
+	}
+	for _, i := range inv {
+		if h.reports[i.SerialNumber] == i.LastReportDate {
+			continue
 		}
+		h.reports[i.SerialNumber] = i.LastReportDate
 
-		err = e.GetLocalSessionCookie()
-		if err != nil {
-			return
+		//a silent inverter keeps its last report, do not record it
+		if s.Time.Sub(time.Unix(int64(i.LastReportDate), 0)) > inverterReportMaxAge {
+			continue
 		}
+		s.Inverters[i.SerialNumber] = float64(i.LastReportWatts)
 	}
 
-	return
+	if !s.HasPower && len(s.Inverters) == 0 {
+		return
+	}
+
+	err := models.Record(&s)
+	if err != nil && !errors.Is(err, models.ErrHistoryDisabled) {
+		logging.Errorf("Failed to record history: %v", err)
+	}
 }
@@ -0,0 +1,213 @@
+package app
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/websocket/v2"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	eventQueueSize = 16
+	eventKeepAlive = time.Second * 15
+)
+
+type event struct {
+	Type    string      `json:"type"`
+	Gateway string      `json:"gateway"`
+	Data    interface{} `json:"data"`
+}
+
+// eventHub broadcasts new data to the SSE and websocket clients. Clients
+// receive the events of one gateway, or of all if they did not choose one.
+type eventHub struct {
+	mu      sync.Mutex
+	clients map[chan []byte]string
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{
+		clients: make(map[chan []byte]string),
+	}
+}
+
+func (h *eventHub) subscribe(gateway string) chan []byte {
+	ch := make(chan []byte, eventQueueSize)
+
+	h.mu.Lock()
+	h.clients[ch] = gateway
+	h.mu.Unlock()
+
+	return ch
+}
+
+func (h *eventHub) unsubscribe(ch chan []byte) {
+	h.mu.Lock()
+	delete(h.clients, ch)
+	h.mu.Unlock()
+}
+
+func encodeEvent(gateway, kind string, data interface{}) []byte {
+	b, err := json.Marshal(event{Type: kind, Gateway: gateway, Data: data})
+	if err != nil {
+		logging.Errorf("Failed to marshal %s event: %v", kind, err)
+		return nil
+	}
+	return b
+}
+
+// publish sends an event to all clients. Slow clients that did not read
+// their queue lose the event.
+func (h *eventHub) publish(gateway, kind string, data interface{}) {
+	b := encodeEvent(gateway, kind, data)
+	if b == nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for ch, g := range h.clients {
+		if g != "" && g != gateway {
+			continue
+		}
+
+		select {
+		case ch <- b:
+		default:
+			logging.Debugln("event client too slow, dropping event")
+		}
+	}
+}
+
+// currentEvents returns the events sent to new clients, for one gateway or
+// for all if gateway is empty
+func (a *AppServer) currentEvents(gateway string) (events [][]byte) {
+	for _, s := range a.sites {
+		if gateway != "" && gateway != s.name {
+			continue
+		}
+
+		prod, _ := s.production()
+		inventory, _ := s.data.getInventory()
+		inverters, _ := s.data.getInverters()
+
+		events = append(events,
+			encodeEvent(s.name, datasetProduction, prod),
+			encodeEvent(s.name, datasetInventory, inventory),
+			encodeEvent(s.name, datasetInverters, inverters),
+		)
+		if battery, info := s.data.getBattery(); !info.FetchedAt.IsZero() {
+			events = append(events, encodeEvent(s.name, datasetBattery, battery))
+		}
+		if live, info := s.data.getLiveData(); !info.FetchedAt.IsZero() {
+			events = append(events, encodeEvent(s.name, datasetLiveData, live))
+		}
+		if meters, info := s.data.getMeters(); !info.FetchedAt.IsZero() {
+			events = append(events, encodeEvent(s.name, datasetMeters, meters))
+		}
+	}
+	return
+}
+
+// eventsGateway returns the gateway chosen by the client with the gateway
+// query parameter
+func (a *AppServer) eventsGateway(c *fiber.Ctx) (string, error) {
+	g := c.Query("gateway")
+	if g != "" && a.site(g) == nil {
+		return "", fiber.NewError(fiber.StatusNotFound, fmt.Sprintf("unknown gateway %q", g))
+	}
+	return g, nil
+}
+
+func (a *AppServer) apiEvents(c *fiber.Ctx) error {
+	gateway, err := a.eventsGateway(c)
+	if err != nil {
+		return err
+	}
+
+	c.Set("Content-Type", "text/event-stream")
+	c.Set("Cache-Control", "no-cache")
+	c.Set("Connection", "keep-alive")
+	c.Set("X-Accel-Buffering", "no")
+
+	ch := a.events.subscribe(gateway)
+	initial := a.currentEvents(gateway)
+
+	c.Context().SetBodyStreamWriter(fasthttp.StreamWriter(func(w *bufio.Writer) {
+		defer a.events.unsubscribe(ch)
+
+		for _, b := range initial {
+			fmt.Fprintf(w, "data: %s\n\n", b)
+		}
+		if err := w.Flush(); err != nil {
+			return
+		}
+
+		for {
+			select {
+			case <-a.ctx.Done():
+				return
+			case b := <-ch:
+				fmt.Fprintf(w, "data: %s\n\n", b)
+			case <-time.After(eventKeepAlive):
+				fmt.Fprintf(w, ": keepalive\n\n")
+			}
+
+			//Flush fails when the client is gone
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}))
+
+	return nil
+}
+
+func (a *AppServer) apiWebsocket(conn *websocket.Conn, gateway string) {
+	ch := a.events.subscribe(gateway)
+	defer a.events.unsubscribe(ch)
+
+	//Messages from the client are ignored, reading is only used to detect
+	//when the connection is closed
+	closed := make(chan interface{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for _, b := range a.currentEvents(gateway) {
+		if err := conn.WriteMessage(websocket.TextMessage, b); err != nil {
+			return
+		}
+	}
+
+	for {
+		var err error
+
+		select {
+		case <-a.ctx.Done():
+			conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+			return
+		case <-closed:
+			return
+		case b := <-ch:
+			err = conn.WriteMessage(websocket.TextMessage, b)
+		case <-time.After(eventKeepAlive):
+			err = conn.WriteMessage(websocket.PingMessage, nil)
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package app
+
+import (
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/raoulh/go-envoy/internal/config"
+	"github.com/raoulh/go-envoy/internal/systemd"
+)
+
+// the poll loop is considered stuck when it did not run for that long, it
+// reads at most 6 datasets then sleeps at most pollMaxSleep
+const pollStallTimeout = 2 * (6*dataReadTimeout + pollMaxSleep)
+
+type healthResponse struct {
+	Status string `json:"status"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// alive returns an error message if the poll loop is stuck
+func (s *site) alive(now time.Time) string {
+	last := s.stats.lastBeatTime()
+	if last.IsZero() {
+		last = s.app.startedAt
+	}
+	if now.Sub(last) > pollStallTimeout {
+		return "gateway polling is stuck"
+	}
+	return ""
+}
+
+// ready returns an error message if the gateway is not authenticated or the
+// data is not fresh
+func (s *site) ready(now time.Time) string {
+	if r := s.alive(now); r != "" {
+		return r
+	}
+	if !s.session.Authenticated() {
+		return "not authenticated on the gateway"
+	}
+
+	info := s.data.getInfo(datasetProduction)
+	if info.stale(now, s.maxAge(datasetProduction, config.Config.Duration("health.ready_max_age"))) {
+		return "no fresh data from the gateway"
+	}
+	return ""
+}
+
+// alive returns an error message if the poll loop of a gateway is stuck
+func (a *AppServer) alive(now time.Time) string {
+	for _, s := range a.sites {
+		if r := s.alive(now); r != "" {
+			return s.name + ": " + r
+		}
+	}
+	return ""
+}
+
+// ready returns an error message if a gateway is not ready
+func (a *AppServer) ready(now time.Time) string {
+	for _, s := range a.sites {
+		if r := s.ready(now); r != "" {
+			return s.name + ": " + r
+		}
+	}
+	return ""
+}
+
+func sendHealth(c *fiber.Ctx, reason string) error {
+	if reason != "" {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(healthResponse{Status: "error", Reason: reason})
+	}
+	return c.JSON(healthResponse{Status: "ok"})
+}
+
+// apiHealthz fails when the daemon is not working anymore
+func (a *AppServer) apiHealthz(c *fiber.Ctx) error {
+	return sendHealth(c, a.alive(time.Now()))
+}
+
+// apiReadyz fails when the daemon is not able to serve fresh data
+func (a *AppServer) apiReadyz(c *fiber.Ctx) error {
+	return sendHealth(c, a.ready(time.Now()))
+}
+
+func notify(state string) {
+	if _, err := systemd.Notify(state); err != nil {
+		logging.Errorf("Failed to notify systemd: %v", err)
+	}
+}
+
+// loginFailing returns true if the last login on a gateway failed, restarting
+// the daemon would only reset the breaker and log in again
+func (a *AppServer) loginFailing() bool {
+	for _, s := range a.sites {
+		if s.gateway.BreakerStatus().Failures > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// runNotify reports the state of the daemon to systemd. READY=1 is sent
+// right away, the http server is serving, and the readiness for data is left
+// to /readyz. The watchdog is not pinged anymore if the poll loop is stuck or
+// if the daemon was not ready for health.unready_restart while it could log
+// in, so that systemd restarts it.
+func (a *AppServer) runNotify() {
+	defer a.wgDone.Done()
+
+	notify(systemd.Ready)
+
+	interval := systemd.WatchdogInterval() / 2
+	check := interval
+	if check <= 0 || check > 5*time.Second {
+		check = 5 * time.Second
+	}
+	if interval > 0 {
+		logging.Infoln("systemd watchdog enabled, interval", interval)
+	}
+
+	unreadyRestart := config.Config.Duration("health.unready_restart")
+	notReadySince := time.Now()
+	lastReason := ""
+	lastPing := time.Time{}
+
+	for {
+		now := time.Now()
+		reason := a.ready(now)
+
+		if reason == "" {
+			notReadySince = time.Time{}
+		} else if notReadySince.IsZero() {
+			notReadySince = now
+		}
+
+		if reason != lastReason {
+			if reason == "" {
+				notify(systemd.Status("Gateway data is up to date"))
+			} else {
+				notify(systemd.Status(reason))
+			}
+			lastReason = reason
+		}
+
+		healthy := a.alive(now) == "" &&
+			(reason == "" || unreadyRestart <= 0 || a.loginFailing() ||
+				now.Sub(notReadySince) < unreadyRestart)
+
+		if interval > 0 && now.Sub(lastPing) >= interval {
+			if healthy {
+				notify(systemd.Watchdog)
+				lastPing = now
+			} else {
+				logging.Warnf("Not pinging systemd watchdog: %s", reason)
+			}
+		}
+
+		select {
+		case <-a.ctx.Done():
+			notify(systemd.Stopping)
+			return
+		case <-time.After(check):
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package app
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/raoulh/go-envoy/internal/models"
+)
+
+const (
+	historyDefaultRange = 24 * time.Hour
+	historyDefaultStep  = 5 * time.Minute
+	historyMaxPoints    = 10000
+)
+
+type historyValue struct {
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+}
+
+type historyResponse struct {
+	Metric     string            `json:"metric"`
+	From       time.Time         `json:"from"`
+	To         time.Time         `json:"to"`
+	Step       string            `json:"step"`
+	Agg        string            `json:"agg"`
+	Unit       string            `json:"unit"`
+	Resolution models.Resolution `json:"resolution"`
+	Points     []historyValue    `json:"points"`
+}
+
+// parseTime accepts RFC3339 dates and unix timestamps
+func parseTime(s string, def time.Time) (time.Time, error) {
+	if s == "" {
+		return def, nil
+	}
+	if ts, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(ts, 0), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// historySeries returns the series name in the history for a metric of a
+// gateway, the primary one if none is given
+func (a *AppServer) historySeries(c *fiber.Ctx) (string, error) {
+	s := a.primarySite()
+	if g := c.Query("gateway"); g != "" {
+		if s = a.site(g); s == nil {
+			return "", fmt.Errorf("unknown gateway %q", g)
+		}
+	}
+
+	switch m := c.Query("metric", models.SeriesProduction); m {
+	case models.SeriesProduction, models.SeriesConsumption, models.SeriesNet:
+		return models.SiteSeries(s.historySite(), m), nil
+	case "inverter":
+		sn := c.Query("serial")
+		if sn == "" {
+			return "", errors.New("serial is required for inverter metric")
+		}
+		return models.SiteSeries(s.historySite(), models.SeriesInverter+sn), nil
+	default:
+		return "", fmt.Errorf("unknown metric %q", m)
+	}
+}
+
+// historyRange reads the from, to and step parameters of a history query
+func historyRange(c *fiber.Ctx) (from, to time.Time, step time.Duration, err error) {
+	to, err = parseTime(c.Query("to"), time.Now())
+	if err != nil {
+		err = fiber.NewError(fiber.StatusBadRequest, "invalid to: "+err.Error())
+		return
+	}
+	from, err = parseTime(c.Query("from"), to.Add(-historyDefaultRange))
+	if err != nil {
+		err = fiber.NewError(fiber.StatusBadRequest, "invalid from: "+err.Error())
+		return
+	}
+	if !from.Before(to) {
+		err = fiber.NewError(fiber.StatusBadRequest, "from must be before to")
+		return
+	}
+
+	step = historyDefaultStep
+	if s := c.Query("step"); s != "" {
+		if step, err = time.ParseDuration(s); err != nil || step <= 0 {
+			err = fiber.NewError(fiber.StatusBadRequest, "invalid step")
+			return
+		}
+	}
+	if to.Sub(from)/step > historyMaxPoints {
+		err = fiber.NewError(fiber.StatusBadRequest, "too many points, use a larger step")
+	}
+	return
+}
+
+// apiHistory returns the history of a metric.
+// Parameters: gateway, metric (production, consumption, net, inverter), serial
+// (for inverter), from and to (RFC3339 or unix time), step (duration), agg (avg,
+// min, max, sum) and format (json, csv). sum returns the energy in Wh.
+func (a *AppServer) apiHistory(c *fiber.Ctx) error {
+	series, err := a.historySeries(c)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+
+	from, to, step, err := historyRange(c)
+	if err != nil {
+		return err
+	}
+
+	agg := c.Query("agg", "avg")
+	unit := "W"
+	var value func(p *models.Point) float64
+	switch agg {
+	case "avg":
+		value = func(p *models.Point) float64 { return p.Avg }
+	case "min":
+		value = func(p *models.Point) float64 { return p.Min }
+	case "max":
+		value = func(p *models.Point) float64 { return p.Max }
+	case "sum":
+		unit = "Wh"
+		value = func(p *models.Point) float64 { return p.Wh }
+	default:
+		return fiber.NewError(fiber.StatusBadRequest, "invalid agg")
+	}
+
+	points, res, err := models.Query(series, from, to, step)
+	if errors.Is(err, models.ErrHistoryDisabled) {
+		return fiber.NewError(fiber.StatusNotFound, err.Error())
+	}
+	if err != nil {
+		return err
+	}
+
+	r := historyResponse{
+		Metric:     series,
+		From:       from,
+		To:         to,
+		Step:       step.String(),
+		Agg:        agg,
+		Unit:       unit,
+		Resolution: res,
+		Points:     make([]historyValue, 0, len(points)),
+	}
+	for i := range points {
+		r.Points = append(r.Points, historyValue{Time: points[i].Time, Value: value(&points[i])})
+	}
+
+	if c.Query("format") == "csv" {
+		return sendHistoryCSV(c, &r)
+	}
+
+	return c.JSON(r)
+}
+
+func sendHistoryCSV(c *fiber.Ctx, r *historyResponse) error {
+	var b bytes.Buffer
+	w := csv.NewWriter(&b)
+
+	w.Write([]string{"time", r.Agg + "_" + r.Unit})
+	for _, p := range r.Points {
+		w.Write([]string{p.Time.Format(time.RFC3339), strconv.FormatFloat(p.Value, 'f', -1, 64)})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+
+	c.Set(fiber.HeaderContentType, "text/csv; charset=utf-8")
+	return c.Send(b.Bytes())
+}
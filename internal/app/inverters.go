@@ -0,0 +1,272 @@
+package app
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/raoulh/go-envoy/internal/config"
+	"github.com/raoulh/go-envoy/internal/models"
+	"github.com/raoulh/go-envoy/pkg/envoy"
+)
+
+const (
+	// inverters report every 5 minutes, older reports are not recorded
+	inverterReportMaxAge = 15 * time.Minute
+
+	inverterMaxDays = 366
+)
+
+type inverterDay struct {
+	Date     string  `json:"date"`
+	EnergyWh float64 `json:"energy_wh"`
+	// MedianWh is the median energy of all the inverters that day
+	MedianWh float64 `json:"median_wh"`
+	// Performance is EnergyWh relative to MedianWh, 1 is the median
+	Performance     float64 `json:"performance"`
+	Underperforming bool    `json:"underperforming"`
+	// Complete is false for today
+	Complete bool `json:"complete"`
+}
+
+type inverterHistoryResponse struct {
+	Inverter envoy.InverterStatus `json:"inverter"`
+	Days     []inverterDay        `json:"days"`
+	// UnderperformingDays is the number of complete days in a row, up to
+	// yesterday, the inverter underperformed
+	UnderperformingDays int  `json:"underperforming_days"`
+	Flagged             bool `json:"flagged"`
+
+	From   time.Time      `json:"from"`
+	To     time.Time      `json:"to"`
+	Step   string         `json:"step"`
+	Points []historyValue `json:"points"`
+}
+
+// dayStarts returns the local midnight of the last n days, today last
+func dayStarts(now time.Time, n int) []time.Time {
+	y, m, d := now.Date()
+	today := time.Date(y, m, d, 0, 0, 0, 0, now.Location())
+
+	days := make([]time.Time, n)
+	for i := range days {
+		days[i] = today.AddDate(0, 0, i-n+1)
+	}
+	return days
+}
+
+// inverterEnergy returns the energy of each inverter for each day, in Wh. An
+// inverter without data has no energy. Days are split on local midnights.
+func (s *site) inverterEnergy(serials []string, days []time.Time, now time.Time) (map[string][]float64, error) {
+	series := make([]string, len(serials))
+	for i, sn := range serials {
+		series[i] = models.SiteSeries(s.historySite(), models.SeriesInverter+sn)
+	}
+
+	e, err := models.Energy(series, append(append([]time.Time{}, days...), now))
+	if err != nil {
+		return nil, err
+	}
+
+	energy := make(map[string][]float64, len(serials))
+	for i, sn := range serials {
+		energy[sn] = e[series[i]]
+	}
+	return energy, nil
+}
+
+// inverterDays returns the daily energy of each inverter over n days, today
+// last, compared to the median of all the inverters
+func (s *site) inverterDays(serials []string, n int, now time.Time) (map[string][]inverterDay, error) {
+	days := dayStarts(now, n)
+	energy, err := s.inverterEnergy(serials, days, now)
+	if err != nil {
+		return nil, err
+	}
+
+	ratio := config.Config.Float64("inverters.min_ratio")
+	res := make(map[string][]inverterDay, len(serials))
+	for i, day := range days {
+		all := make([]float64, 0, len(energy))
+		for _, e := range energy {
+			all = append(all, e[i])
+		}
+		median := envoy.Median(all)
+
+		for _, sn := range serials {
+			d := inverterDay{
+				Date:     day.Format("2006-01-02"),
+				EnergyWh: energy[sn][i],
+				MedianWh: median,
+				Complete: i < len(days)-1,
+			}
+			if d.MedianWh > 0 {
+				d.Performance = d.EnergyWh / d.MedianWh
+				d.Underperforming = d.Performance < ratio
+			}
+			res[sn] = append(res[sn], d)
+		}
+	}
+
+	return res, nil
+}
+
+// underperformingDays returns the number of complete days in a row, up to
+// yesterday, the inverter underperformed and if it is flagged for it
+func underperformingDays(days []inverterDay) (n int, flagged bool) {
+	for i := len(days) - 2; i >= 0 && days[i].Underperforming; i-- {
+		n++
+	}
+	return n, n >= config.Config.Int("inverters.flag_days")
+}
+
+// inverterFlags caches the underperforming days of the inverters, they only
+// change with the day
+type inverterFlags struct {
+	mu    sync.Mutex
+	day   time.Time
+	days  map[string]int
+	valid bool
+}
+
+// underperforming returns the number of days in a row each inverter
+// underperformed, see underperformingDays. It is computed once a day, for
+// the days of the inverters config.
+func (s *site) underperforming(serials []string, now time.Time) (map[string]int, error) {
+	f := &s.inverterFlags
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	today := dayStarts(now, 1)[0]
+	if f.valid && f.day.Equal(today) {
+		missing := false
+		for _, sn := range serials {
+			if _, ok := f.days[sn]; !ok {
+				missing = true
+				break
+			}
+		}
+		if !missing {
+			return f.days, nil
+		}
+	}
+
+	days, err := s.inverterDays(serials, config.Config.Int("inverters.days"), now)
+	if err != nil {
+		return nil, err
+	}
+
+	f.days = make(map[string]int, len(days))
+	for sn, d := range days {
+		f.days[sn], _ = underperformingDays(d)
+	}
+	f.day = today
+	f.valid = true
+
+	return f.days, nil
+}
+
+// inverterReport is an inverter joined with its inventory and flagged when
+// its daily energy was below the others for inverters.flag_days
+type inverterReport struct {
+	envoy.InverterStatus
+	// UnderperformingDays is the number of complete days in a row, up to
+	// yesterday, the inverter underperformed
+	UnderperformingDays int  `json:"underperforming_days"`
+	Flagged             bool `json:"flagged"`
+}
+
+// apiInverters returns the inverters with their instantaneous performance,
+// from the last report, and the daily one from the history
+func apiInverters(c *fiber.Ctx, s *site) error {
+	inverters, info := s.data.getInverters()
+	inventory, _ := s.data.getInventory()
+
+	status := envoy.JoinInverters(inverters, inventory)
+	serials := make([]string, len(status))
+	for i := range status {
+		serials[i] = status[i].SerialNumber
+	}
+
+	under, err := s.underperforming(serials, time.Now())
+	if err != nil && !errors.Is(err, models.ErrHistoryDisabled) {
+		s.logger().Errorf("Failed to read inverters history: %v", err)
+	}
+
+	flagDays := config.Config.Int("inverters.flag_days")
+	r := make([]inverterReport, len(status))
+	for i := range status {
+		n := under[status[i].SerialNumber]
+		r[i] = inverterReport{
+			InverterStatus:      status[i],
+			UnderperformingDays: n,
+			Flagged:             n >= flagDays,
+		}
+	}
+
+	return s.sendDataset(c, datasetInverters, info, r)
+}
+
+// apiInverterHistory returns an inverter joined with its inventory, its daily
+// energy compared to the other inverters and its power curve.
+// Parameters: days (number of days, today included), from, to and step for
+// the power curve, see apiHistory.
+func apiInverterHistory(c *fiber.Ctx, s *site) error {
+	sn := c.Params("serial")
+
+	inverters, _ := s.data.getInverters()
+	inventory, _ := s.data.getInventory()
+
+	r := inverterHistoryResponse{}
+	found := false
+	serials := make([]string, 0, len(inverters))
+	for _, i := range envoy.JoinInverters(inverters, inventory) {
+		serials = append(serials, i.SerialNumber)
+		if i.SerialNumber == sn {
+			r.Inverter = i
+			found = true
+		}
+	}
+	if !found {
+		return fiber.NewError(fiber.StatusNotFound, "unknown inverter "+sn)
+	}
+
+	n := config.Config.Int("inverters.days")
+	if d := c.Query("days"); d != "" {
+		var err error
+		if n, err = strconv.Atoi(d); err != nil || n <= 0 || n > inverterMaxDays {
+			return fiber.NewError(fiber.StatusBadRequest, "invalid days")
+		}
+	}
+
+	from, to, step, err := historyRange(c)
+	if err != nil {
+		return err
+	}
+
+	days, err := s.inverterDays(serials, n, time.Now())
+	if errors.Is(err, models.ErrHistoryDisabled) {
+		return fiber.NewError(fiber.StatusNotFound, err.Error())
+	}
+	if err != nil {
+		return err
+	}
+	r.Days = days[sn]
+	r.UnderperformingDays, r.Flagged = underperformingDays(r.Days)
+
+	points, _, err := models.Query(models.SiteSeries(s.historySite(), models.SeriesInverter+sn), from, to, step)
+	if err != nil {
+		return err
+	}
+	r.From = from
+	r.To = to
+	r.Step = step.String()
+	r.Points = make([]historyValue, 0, len(points))
+	for _, p := range points {
+		r.Points = append(r.Points, historyValue{Time: p.Time, Value: p.Avg})
+	}
+
+	return c.JSON(r)
+}
@@ -0,0 +1,282 @@
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/raoulh/go-envoy/pkg/envoy"
+)
+
+const metricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+// metricsWriter writes the OpenMetrics text format. labels are added to all
+// samples.
+type metricsWriter struct {
+	b      bytes.Buffer
+	labels []string
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// family writes the header of a metric family, all samples of the family
+// must follow it.
+func (w *metricsWriter) family(name, typ, unit, help string) {
+	fmt.Fprintf(&w.b, "# TYPE %s %s\n", name, typ)
+	if unit != "" {
+		fmt.Fprintf(&w.b, "# UNIT %s %s\n", name, unit)
+	}
+	fmt.Fprintf(&w.b, "# HELP %s %s\n", name, help)
+}
+
+// sample writes a sample, labels are given as name, value pairs
+func (w *metricsWriter) sample(name string, v float64, labels ...string) {
+	if len(w.labels) > 0 {
+		labels = append(append([]string{}, w.labels...), labels...)
+	}
+
+	w.b.WriteString(name)
+	if len(labels) > 0 {
+		w.b.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				w.b.WriteByte(',')
+			}
+			fmt.Fprintf(&w.b, `%s="%s"`, labels[i], labelEscaper.Replace(labels[i+1]))
+		}
+		w.b.WriteByte('}')
+	}
+	w.b.WriteByte(' ')
+	w.b.WriteString(strconv.FormatFloat(v, 'g', -1, 64))
+	w.b.WriteByte('\n')
+}
+
+// siteMetrics holds the data of a gateway exported in the metrics
+type siteMetrics struct {
+	site       *site
+	production envoy.Production
+	inverters  []envoy.Inverter
+	inventory  []envoy.Inventory
+}
+
+// forSites calls f for each gateway with the gateway label set
+func (w *metricsWriter) forSites(sites []siteMetrics, f func(sm *siteMetrics)) {
+	for i := range sites {
+		w.labels = []string{"gateway", sites[i].site.name}
+		f(&sites[i])
+	}
+	w.labels = nil
+}
+
+func (w *metricsWriter) gauge(sites []siteMetrics, name, unit, help string, v func(sm *siteMetrics) float64) {
+	w.family(name, "gauge", unit, help)
+	w.forSites(sites, func(sm *siteMetrics) { w.sample(name, v(sm)) })
+}
+
+func (w *metricsWriter) counter(sites []siteMetrics, name, help string, v func(sm *siteMetrics) float64) {
+	w.family(name, "counter", "", help)
+	w.forSites(sites, func(sm *siteMetrics) { w.sample(name+"_total", v(sm)) })
+}
+
+func boolMetric(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// entryMetric describes how a field of the production endpoint is exported.
+// field is its json name, entries without it are skipped. line is nil for
+// fields that are not reported per phase.
+type entryMetric struct {
+	name  string
+	field string
+	unit  string
+	help  string
+	entry func(e *envoy.Entry) float64
+	line  func(l *envoy.Line) float64
+}
+
+var entryMetrics = []entryMetric{
+	{"envoy_active_count", "activeCount", "", "Number of active devices", func(e *envoy.Entry) float64 { return float64(e.ActiveCount) }, nil},
+	{"envoy_reading_timestamp_seconds", "readingTime", "seconds", "Time of the reading", func(e *envoy.Entry) float64 { return float64(e.ReadingTime) }, nil},
+	{"envoy_power_watts", "wNow", "watts", "Active power", func(e *envoy.Entry) float64 { return e.WNow }, func(l *envoy.Line) float64 { return l.WNow }},
+	{"envoy_reactive_power_var", "reactPwr", "var", "Reactive power", func(e *envoy.Entry) float64 { return e.ReactPwr }, func(l *envoy.Line) float64 { return l.ReactPwr }},
+	{"envoy_apparent_power_va", "apprntPwr", "va", "Apparent power", func(e *envoy.Entry) float64 { return e.ApprntPwr }, func(l *envoy.Line) float64 { return l.ApprntPwr }},
+	{"envoy_power_factor", "pwrFactor", "", "Power factor", func(e *envoy.Entry) float64 { return e.PwrFactor }, func(l *envoy.Line) float64 { return l.PwrFactor }},
+	{"envoy_voltage_volts", "rmsVoltage", "volts", "RMS voltage", func(e *envoy.Entry) float64 { return e.RmsVoltage }, func(l *envoy.Line) float64 { return l.RmsVoltage }},
+	{"envoy_current_amperes", "rmsCurrent", "amperes", "RMS current", func(e *envoy.Entry) float64 { return e.RmsCurrent }, func(l *envoy.Line) float64 { return l.RmsCurrent }},
+	{"envoy_energy_now_watthours", "whNow", "watthours", "Energy stored now", func(e *envoy.Entry) float64 { return e.WhNow }, nil},
+	{"envoy_energy_lifetime_watthours", "whLifetime", "watthours", "Lifetime active energy", func(e *envoy.Entry) float64 { return e.WhLifetime }, func(l *envoy.Line) float64 { return l.WhLifetime }},
+	{"envoy_energy_today_watthours", "whToday", "watthours", "Active energy today", func(e *envoy.Entry) float64 { return e.WhToday }, func(l *envoy.Line) float64 { return l.WhToday }},
+	{"envoy_energy_last_seven_days_watthours", "whLastSevenDays", "watthours", "Active energy of the last seven days", func(e *envoy.Entry) float64 { return e.WhLastSevenDays }, func(l *envoy.Line) float64 { return l.WhLastSevenDays }},
+	{"envoy_apparent_energy_lifetime_vah", "vahLifetime", "vah", "Lifetime apparent energy", func(e *envoy.Entry) float64 { return e.VahLifetime }, func(l *envoy.Line) float64 { return l.VahLifetime }},
+	{"envoy_apparent_energy_today_vah", "vahToday", "vah", "Apparent energy today", func(e *envoy.Entry) float64 { return e.VahToday }, func(l *envoy.Line) float64 { return l.VahToday }},
+	{"envoy_reactive_energy_lead_lifetime_varh", "varhLeadLifetime", "varh", "Lifetime leading reactive energy", func(e *envoy.Entry) float64 { return e.VarhLeadLifetime }, func(l *envoy.Line) float64 { return l.VarhLeadLifetime }},
+	{"envoy_reactive_energy_lag_lifetime_varh", "varhLagLifetime", "varh", "Lifetime lagging reactive energy", func(e *envoy.Entry) float64 { return e.VarhLagLifetime }, func(l *envoy.Line) float64 { return l.VarhLagLifetime }},
+	{"envoy_reactive_energy_lead_today_varh", "varhLeadToday", "varh", "Leading reactive energy today", func(e *envoy.Entry) float64 { return e.VarhLeadToday }, func(l *envoy.Line) float64 { return l.VarhLeadToday }},
+	{"envoy_reactive_energy_lag_today_varh", "varhLagToday", "varh", "Lagging reactive energy today", func(e *envoy.Entry) float64 { return e.VarhLagToday }, func(l *envoy.Line) float64 { return l.VarhLagToday }},
+}
+
+var phaseNames = []string{"a", "b", "c"}
+
+func (w *metricsWriter) writeProduction(sites []siteMetrics) {
+	for _, m := range entryMetrics {
+		w.family(m.name, "gauge", m.unit, m.help)
+
+		w.forSites(sites, func(sm *siteMetrics) {
+			p := &sm.production
+			sections := []struct {
+				name    string
+				entries []envoy.Entry
+			}{
+				{"production", p.Production},
+				{"consumption", p.Consumption},
+				{"storage", p.Storage},
+			}
+
+			for _, sec := range sections {
+				for i := range sec.entries {
+					e := &sec.entries[i]
+					if !e.Has(m.field) {
+						continue
+					}
+					measurement := e.MeasurementType
+					if measurement == "" {
+						measurement = sec.name
+					}
+
+					w.sample(m.name, m.entry(e), "section", sec.name, "type", e.Type, "measurement", measurement, "phase", "total")
+
+					if m.line == nil {
+						continue
+					}
+					for j := range e.Lines {
+						phase := strconv.Itoa(j)
+						if j < len(phaseNames) {
+							phase = phaseNames[j]
+						}
+						w.sample(m.name, m.line(&e.Lines[j]), "section", sec.name, "type", e.Type, "measurement", measurement, "phase", phase)
+					}
+				}
+			}
+		})
+	}
+}
+
+func (w *metricsWriter) writeInverters(sites []siteMetrics) {
+	values := []struct {
+		name  string
+		unit  string
+		help  string
+		value func(i *envoy.Inverter) float64
+	}{
+		{"envoy_inverter_last_report_watts", "watts", "Last power reported by the inverter", func(i *envoy.Inverter) float64 { return float64(i.LastReportWatts) }},
+		{"envoy_inverter_max_report_watts", "watts", "Maximum power reported by the inverter", func(i *envoy.Inverter) float64 { return float64(i.MaxReportWatts) }},
+		{"envoy_inverter_last_report_timestamp_seconds", "seconds", "Time of the last report of the inverter", func(i *envoy.Inverter) float64 { return float64(i.LastReportDate) }},
+	}
+
+	for _, v := range values {
+		w.family(v.name, "gauge", v.unit, v.help)
+		w.forSites(sites, func(sm *siteMetrics) {
+			for i := range sm.inverters {
+				w.sample(v.name, v.value(&sm.inverters[i]), "serial", sm.inverters[i].SerialNumber)
+			}
+		})
+	}
+}
+
+func (w *metricsWriter) writeInventory(sites []siteMetrics) {
+	states := []struct {
+		name  string
+		help  string
+		value func(d *envoy.Device) bool
+	}{
+		{"envoy_device_producing", "Device is producing", func(d *envoy.Device) bool { return d.Producing }},
+		{"envoy_device_communicating", "Device is communicating", func(d *envoy.Device) bool { return d.Communicating }},
+		{"envoy_device_provisioned", "Device is provisioned", func(d *envoy.Device) bool { return d.Provisioned }},
+		{"envoy_device_operating", "Device is operating", func(d *envoy.Device) bool { return d.Operating }},
+	}
+
+	for _, st := range states {
+		w.family(st.name, "gauge", "", st.help)
+		w.forSites(sites, func(sm *siteMetrics) {
+			for _, t := range sm.inventory {
+				for i := range t.Devices {
+					d := &t.Devices[i]
+					w.sample(st.name, boolMetric(st.value(d)), "type", t.Type, "serial", d.SerialNum, "part_num", d.PartNum)
+				}
+			}
+		})
+	}
+}
+
+func (w *metricsWriter) writeSelf(sites []siteMetrics) {
+	w.counter(sites, "envoy_polls", "Number of polls of the gateway", func(sm *siteMetrics) float64 {
+		polls, _, _, _ := sm.site.stats.snapshot()
+		return float64(polls)
+	})
+	w.counter(sites, "envoy_poll_errors", "Number of polls that failed", func(sm *siteMetrics) float64 {
+		_, pollErrors, _, _ := sm.site.stats.snapshot()
+		return float64(pollErrors)
+	})
+	w.gauge(sites, "envoy_poll_duration_seconds", "seconds", "Duration of the last poll", func(sm *siteMetrics) float64 {
+		_, _, lastDuration, _ := sm.site.stats.snapshot()
+		return lastDuration.Seconds()
+	})
+	w.gauge(sites, "envoy_last_successful_poll_timestamp_seconds", "seconds", "Time of the last successful poll", func(sm *siteMetrics) float64 {
+		_, _, _, lastSuccess := sm.site.stats.snapshot()
+		if lastSuccess.IsZero() {
+			return 0
+		}
+		return float64(lastSuccess.UnixNano()) / 1e9
+	})
+
+	w.counter(sites, "envoy_logins", "Number of logins on enlighten", func(sm *siteMetrics) float64 {
+		return float64(sm.site.gateway.Stats().Logins)
+	})
+	w.counter(sites, "envoy_auth_failures", "Number of failed logins on enlighten", func(sm *siteMetrics) float64 {
+		return float64(sm.site.gateway.Stats().AuthFailures)
+	})
+	w.gauge(sites, "envoy_login_breaker_open", "", "1 while logins on enlighten are suspended after failures", func(sm *siteMetrics) float64 {
+		if sm.site.gateway.BreakerStatus().State == envoy.BreakerOpen {
+			return 1
+		}
+		return 0
+	})
+	w.counter(sites, "envoy_session_renewals", "Number of sessions opened on the gateway", func(sm *siteMetrics) float64 {
+		return float64(sm.site.gateway.Stats().SessionRenewals)
+	})
+
+	w.gauge(sites, "envoy_token_expiry_timestamp_seconds", "seconds", "Expiry of the enlighten token", func(sm *siteMetrics) float64 {
+		if t := sm.site.gateway.TokenExpiresAt(); !t.IsZero() {
+			return float64(t.Unix())
+		}
+		return 0
+	})
+}
+
+func (a *AppServer) apiMetrics(c *fiber.Ctx) error {
+	w := &metricsWriter{}
+
+	sites := make([]siteMetrics, 0, len(a.sites))
+	for _, s := range a.sites {
+		sm := siteMetrics{site: s}
+		sm.production, _ = s.production()
+		sm.inverters, _ = s.data.getInverters()
+		sm.inventory, _ = s.data.getInventory()
+		sites = append(sites, sm)
+	}
+
+	w.writeProduction(sites)
+	w.writeInverters(sites)
+	w.writeInventory(sites)
+	w.writeSelf(sites)
+
+	w.b.WriteString("# EOF\n")
+
+	c.Set(fiber.HeaderContentType, metricsContentType)
+	return c.Send(w.b.Bytes())
+}
@@ -0,0 +1,324 @@
+package app
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+
+	"github.com/raoulh/go-envoy/internal/config"
+	"github.com/raoulh/go-envoy/pkg/envoy"
+)
+
+const (
+	mqttOnline       = "online"
+	mqttOffline      = "offline"
+	mqttQos          = 1
+	mqttWriteTimeout = time.Second * 5
+)
+
+// mqttPublisher publishes the gateway data on a MQTT broker, with Home
+// Assistant discovery configs
+type mqttPublisher struct {
+	client mqtt.Client
+
+	prefix          string
+	discovery       bool
+	discoveryPrefix string
+	retain          bool
+
+	serial string
+	device haDevice
+
+	//mu protects inverters, the last report date published by serial
+	mu        sync.Mutex
+	inverters map[string]uint64
+}
+
+type mqttState struct {
+	ProductionW            float64 `json:"production_w"`
+	ConsumptionW           float64 `json:"consumption_w"`
+	NetW                   float64 `json:"net_w"`
+	ProductionTodayWh      float64 `json:"production_today_wh"`
+	ConsumptionTodayWh     float64 `json:"consumption_today_wh"`
+	NetTodayWh             float64 `json:"net_today_wh"`
+	ProductionLifetimeWh   float64 `json:"production_lifetime_wh"`
+	ConsumptionLifetimeWh  float64 `json:"consumption_lifetime_wh"`
+	NetLifetimeWh          float64 `json:"net_lifetime_wh"`
+	ProductionReadingTime  int     `json:"production_reading_time,omitempty"`
+	ConsumptionReadingTime int     `json:"consumption_reading_time,omitempty"`
+}
+
+type mqttInverterState struct {
+	Watts      int16  `json:"watts"`
+	MaxWatts   uint16 `json:"max_watts"`
+	LastReport uint64 `json:"last_report"`
+}
+
+type haDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+	Model        string   `json:"model"`
+	ViaDevice    string   `json:"via_device,omitempty"`
+}
+
+type haSensor struct {
+	Name              string   `json:"name"`
+	UniqueId          string   `json:"unique_id"`
+	ObjectId          string   `json:"object_id"`
+	StateTopic        string   `json:"state_topic"`
+	ValueTemplate     string   `json:"value_template"`
+	UnitOfMeasurement string   `json:"unit_of_measurement"`
+	DeviceClass       string   `json:"device_class"`
+	StateClass        string   `json:"state_class"`
+	AvailabilityTopic string   `json:"availability_topic"`
+	Device            haDevice `json:"device"`
+}
+
+// gateway sensors exported to home assistant, the key is the field of mqttState
+var haSensors = []struct {
+	key         string
+	name        string
+	unit        string
+	deviceClass string
+	stateClass  string
+}{
+	{"production_w", "Production", "W", "power", "measurement"},
+	{"consumption_w", "Consumption", "W", "power", "measurement"},
+	{"net_w", "Net import", "W", "power", "measurement"},
+	{"production_today_wh", "Production today", "Wh", "energy", "total_increasing"},
+	{"consumption_today_wh", "Consumption today", "Wh", "energy", "total_increasing"},
+	{"net_today_wh", "Net import today", "Wh", "energy", "total"},
+	{"production_lifetime_wh", "Lifetime production", "Wh", "energy", "total_increasing"},
+	{"consumption_lifetime_wh", "Lifetime consumption", "Wh", "energy", "total_increasing"},
+	{"net_lifetime_wh", "Lifetime net import", "Wh", "energy", "total"},
+}
+
+// newMqttPublisher connects to the broker configured in the mqtt section.
+// Each gateway has its own connection, clientID must be unique. It returns nil
+// if mqtt is not enabled.
+func newMqttPublisher(serial, clientID string) (p *mqttPublisher, err error) {
+	if !config.Config.Bool("mqtt.enabled") {
+		return nil, nil
+	}
+
+	if serial == "" {
+		serial = "envoy"
+	}
+
+	p = &mqttPublisher{
+		prefix:          config.Config.String("mqtt.topic_prefix"),
+		discovery:       config.Config.Bool("mqtt.discovery"),
+		discoveryPrefix: config.Config.String("mqtt.discovery_prefix"),
+		retain:          config.Config.Bool("mqtt.retain"),
+		serial:          serial,
+		device: haDevice{
+			Identifiers:  []string{"envoy_" + serial},
+			Name:         "Envoy " + serial,
+			Manufacturer: "Enphase",
+			Model:        "IQ Gateway",
+		},
+		inverters: make(map[string]uint64),
+	}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(config.Config.String("mqtt.broker")).
+		SetClientID(clientID).
+		SetUsername(config.Config.String("mqtt.username")).
+		SetPassword(config.Config.String("mqtt.password")).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetWriteTimeout(mqttWriteTimeout).
+		SetWill(p.availabilityTopic(), mqttOffline, mqttQos, true).
+		SetOnConnectHandler(p.onConnect).
+		SetConnectionLostHandler(func(c mqtt.Client, err error) {
+			logging.Warnf("MQTT connection lost: %v", err)
+		})
+
+	tlsConfig, err := mqttTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		opts.SetTLSConfig(tlsConfig)
+	}
+
+	p.client = mqtt.NewClient(opts)
+
+	//with ConnectRetry the token completes only when connected, do not wait for it
+	p.client.Connect()
+
+	logging.Infoln("MQTT publishing to", config.Config.String("mqtt.broker"))
+
+	return p, nil
+}
+
+func mqttTLSConfig() (*tls.Config, error) {
+	caFile := config.Config.String("mqtt.ca_file")
+	certFile := config.Config.String("mqtt.cert_file")
+	keyFile := config.Config.String("mqtt.key_file")
+	insecure := config.Config.Bool("mqtt.insecure")
+
+	if caFile == "" && certFile == "" && !insecure {
+		//ssl:// brokers still use TLS with the system roots
+		return nil, nil
+	}
+
+	c := &tls.Config{
+		InsecureSkipVerify: insecure,
+	}
+
+	if caFile != "" {
+		b, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificate found in %s", caFile)
+		}
+	}
+
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+
+	return c, nil
+}
+
+func (p *mqttPublisher) topic(t string) string {
+	return fmt.Sprintf("%s/%s/%s", p.prefix, p.serial, t)
+}
+
+func (p *mqttPublisher) availabilityTopic() string {
+	return p.topic("status")
+}
+
+func (p *mqttPublisher) onConnect(c mqtt.Client) {
+	logging.Infoln("MQTT connected")
+
+	c.Publish(p.availabilityTopic(), mqttQos, true, mqttOnline)
+
+	if !p.discovery {
+		return
+	}
+
+	for _, s := range haSensors {
+		p.publishDiscovery(s.key, s.name, s.unit, s.deviceClass, s.stateClass, p.topic("state"), p.device)
+	}
+
+	//Inverters configs and states are sent again with the next data
+	p.mu.Lock()
+	p.inverters = make(map[string]uint64)
+	p.mu.Unlock()
+}
+
+func (p *mqttPublisher) publishDiscovery(key, name, unit, deviceClass, stateClass, stateTopic string, device haDevice) {
+	id := device.Identifiers[0] + "_" + key
+
+	cfg := haSensor{
+		Name:              name,
+		UniqueId:          id,
+		ObjectId:          id,
+		StateTopic:        stateTopic,
+		ValueTemplate:     fmt.Sprintf("{{ value_json.%s }}", key),
+		UnitOfMeasurement: unit,
+		DeviceClass:       deviceClass,
+		StateClass:        stateClass,
+		AvailabilityTopic: p.availabilityTopic(),
+		Device:            device,
+	}
+
+	b, err := json.Marshal(cfg)
+	if err != nil {
+		logging.Errorf("Failed to marshal discovery config: %v", err)
+		return
+	}
+
+	p.client.Publish(fmt.Sprintf("%s/sensor/%s/%s/config", p.discoveryPrefix, device.Identifiers[0], key), mqttQos, true, b)
+}
+
+func (p *mqttPublisher) publishJSON(topic string, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		logging.Errorf("Failed to marshal %s: %v", topic, err)
+		return
+	}
+
+	p.client.Publish(topic, 0, p.retain, b)
+}
+
+// publish sends the current data
+func (p *mqttPublisher) publish(prod *envoy.Production, inv []envoy.Inverter) {
+	if !p.client.IsConnectionOpen() {
+		return
+	}
+
+	var st mqttState
+	if e := prod.ProductionEntry(); e != nil {
+		st.ProductionW = e.WNow
+		st.ProductionTodayWh = e.WhToday
+		st.ProductionLifetimeWh = e.WhLifetime
+		st.ProductionReadingTime = e.ReadingTime
+	}
+	if e := prod.TotalConsumption(); e != nil {
+		st.ConsumptionW = e.WNow
+		st.ConsumptionTodayWh = e.WhToday
+		st.ConsumptionLifetimeWh = e.WhLifetime
+		st.ConsumptionReadingTime = e.ReadingTime
+	}
+	if e := prod.NetConsumption(); e != nil {
+		st.NetW = e.WNow
+		st.NetTodayWh = e.WhToday
+		st.NetLifetimeWh = e.WhLifetime
+	}
+	p.publishJSON(p.topic("state"), st)
+
+	for _, i := range inv {
+		topic := p.topic("inverter/" + i.SerialNumber)
+
+		//inverters report every 5 minutes, only publish new reports
+		p.mu.Lock()
+		last, known := p.inverters[i.SerialNumber]
+		p.inverters[i.SerialNumber] = i.LastReportDate
+		p.mu.Unlock()
+
+		if known && last == i.LastReportDate {
+			continue
+		}
+
+		if !known && p.discovery {
+			dev := haDevice{
+				Identifiers:  []string{"envoy_inverter_" + i.SerialNumber},
+				Name:         "Inverter " + i.SerialNumber,
+				Manufacturer: "Enphase",
+				Model:        "Microinverter",
+				ViaDevice:    p.device.Identifiers[0],
+			}
+			p.publishDiscovery("watts", "Power", "W", "power", "measurement", topic, dev)
+		}
+
+		p.publishJSON(topic, mqttInverterState{
+			Watts:      i.LastReportWatts,
+			MaxWatts:   i.MaxReportWatts,
+			LastReport: i.LastReportDate,
+		})
+	}
+}
+
+// close marks the gateway offline and disconnects
+func (p *mqttPublisher) close() {
+	t := p.client.Publish(p.availabilityTopic(), mqttQos, true, mqttOffline)
+	t.WaitTimeout(mqttWriteTimeout)
+	p.client.Disconnect(250)
+}
@@ -0,0 +1,244 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/raoulh/go-envoy/internal/config"
+	"github.com/raoulh/go-envoy/pkg/envoy"
+)
+
+// the poll loop wakes up at least that often, even if nothing is due
+const pollMaxSleep = 10 * time.Second
+
+// pollTask is a dataset read from the gateway at its own interval
+type pollTask struct {
+	name  string
+	fetch func(ctx context.Context) error
+
+	next     time.Time
+	failures int
+	// disabled is set when the gateway does not support the dataset
+	disabled bool
+}
+
+// pollSchedule holds the poll settings from the config
+type pollSchedule struct {
+	jitter     float64
+	backoffMax time.Duration
+}
+
+func newPollSchedule() pollSchedule {
+	s := pollSchedule{
+		jitter:     config.Config.Float64("poll.jitter"),
+		backoffMax: config.Config.Duration("poll.backoff_max"),
+	}
+	if s.jitter < 0 {
+		s.jitter = 0
+	}
+	if s.jitter > 1 {
+		s.jitter = 1
+	}
+	return s
+}
+
+// datasets returns the datasets polled on the gateway. The live data, the
+// battery and the meters are only polled if their interval is set.
+func (s *site) datasets() []string {
+	names := []string{datasetProduction, datasetInventory, datasetInverters}
+	for _, name := range []string{datasetLiveData, datasetBattery, datasetMeters} {
+		if config.Config.Duration("poll."+name) > 0 {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func (s *site) newPollTasks() []*pollTask {
+	fetch := map[string]func(ctx context.Context) error{
+		datasetProduction: s.fetchProduction,
+		datasetInventory:  s.fetchInventory,
+		datasetInverters:  s.fetchInverters,
+		datasetBattery:    s.fetchBattery,
+		datasetMeters:     s.fetchMeters,
+		datasetLiveData:   s.fetchLiveData,
+	}
+
+	var tasks []*pollTask
+	for _, name := range s.datasets() {
+		s.logger().Debugf("Polling %s every %v", name, s.pollInterval(name))
+		tasks = append(tasks, &pollTask{name: name, fetch: fetch[name]})
+	}
+
+	return tasks
+}
+
+// pollInterval returns the configured interval of a dataset, taking the
+// night interval into account. The production is read less often while the
+// live data gives the power.
+func (s *site) pollInterval(dataset string) time.Duration {
+	d := config.Config.Duration("poll." + dataset)
+	if live := config.Config.Duration("poll.production_live"); dataset == datasetProduction && live > d && s.liveDataActive() {
+		d = live
+	}
+	if d <= 0 {
+		d = time.Second
+	}
+	if night := config.Config.Duration("poll.night_interval"); night > d && !s.producing() {
+		d = night
+	}
+	return d
+}
+
+// maxAge returns the age after which a dataset is stale. It is at least twice
+// the poll interval so that slow datasets are not always stale. 0 disables the
+// check.
+func (s *site) maxAge(dataset string, configured time.Duration) time.Duration {
+	if configured <= 0 {
+		return 0
+	}
+	if d := 2 * s.pollInterval(dataset); d > configured {
+		return d
+	}
+	return configured
+}
+
+// delay returns the time to wait before the next read of a task polled at
+// interval. It grows exponentially after errors up to backoffMax.
+func (s *pollSchedule) delay(t *pollTask, interval time.Duration) time.Duration {
+	d := interval
+
+	if t.failures > 0 {
+		max := s.backoffMax
+		if max < d {
+			max = d
+		}
+		for i := 0; i < t.failures && d < max; i++ {
+			d *= 2
+		}
+		if d > max {
+			d = max
+		}
+	}
+
+	if s.jitter > 0 {
+		d += time.Duration((rand.Float64()*2 - 1) * s.jitter * float64(d))
+	}
+
+	return d
+}
+
+// runTask reads a dataset and schedules its next read
+func (s *site) runTask(sched *pollSchedule, t *pollTask) error {
+	ctx, cancel := context.WithTimeout(s.app.ctx, dataReadTimeout)
+	err := t.fetch(ctx)
+	cancel()
+
+	if err != nil {
+		t.failures++
+	} else {
+		t.failures = 0
+	}
+
+	d := sched.delay(t, s.pollInterval(t.name))
+	//Retrying will not help until the credentials are fixed
+	if errors.Is(err, envoy.ErrBadCredentials) && d < sched.backoffMax {
+		d = sched.backoffMax
+	}
+	if err != nil {
+		s.logger().Debugf("Next read of %s in %v after %d failures", t.name, d, t.failures)
+	}
+	t.next = time.Now().Add(d)
+
+	return err
+}
+
+// loginError logs why the session could not be created
+func (s *site) loginError(err error) {
+	switch {
+	case errors.Is(err, envoy.ErrBadCredentials):
+		s.logger().Errorf("Failed to login, check username, password and serial: %v", err)
+	case errors.Is(err, envoy.ErrCircuitOpen):
+		s.logger().Warnf("Failed to login: %v", err)
+	case errors.Is(err, envoy.ErrCloudUnavailable):
+		s.logger().Warnf("Failed to login, enlighten is unavailable: %v", err)
+	case errors.Is(err, envoy.ErrGatewayUnreachable):
+		s.logger().Warnf("Failed to login, gateway unreachable: %v", err)
+	default:
+		s.logger().Errorf("Failed to login: %v", err)
+	}
+}
+
+func (s *site) getDataFromGateway() {
+	defer s.app.wgDone.Done()
+
+	sched := newPollSchedule()
+	tasks := s.newPollTasks()
+
+	for {
+		start := time.Now()
+		ran := false
+		ok := true
+
+		for i, t := range tasks {
+			if t.disabled || t.next.After(start) {
+				continue
+			}
+
+			ran = true
+			if err := s.runTask(&sched, t); err != nil {
+				if errors.Is(err, envoy.ErrNotSupported) {
+					s.logger().Infof("%s not supported by the gateway, not reading it anymore", t.name)
+					t.disabled = true
+					continue
+				}
+
+				ok = false
+
+				if !s.session.Authenticated() {
+					s.loginError(err)
+
+					//do not try to login again for each dataset
+					for _, o := range tasks[i+1:] {
+						if o.next.Before(t.next) {
+							o.next = t.next
+						}
+					}
+					break
+				}
+			}
+
+			if s.app.ctx.Err() != nil {
+				break
+			}
+		}
+
+		if ran {
+			s.stats.record(start, ok)
+		}
+		s.stats.beat()
+
+		wait := pollMaxSleep
+		now := time.Now()
+		for _, t := range tasks {
+			if t.disabled {
+				continue
+			}
+			if d := t.next.Sub(now); d < wait {
+				wait = d
+			}
+		}
+		if wait < 0 {
+			wait = 0
+		}
+
+		select {
+		case <-s.app.ctx.Done():
+			s.logger().Debugln("exiting data gather routine")
+			return
+		case <-time.After(wait):
+		}
+	}
+}
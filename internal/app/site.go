@@ -0,0 +1,163 @@
+package app
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/raoulh/go-envoy/internal/config"
+	"github.com/raoulh/go-envoy/pkg/envoy"
+	"github.com/sirupsen/logrus"
+)
+
+// name of the aggregated view of all gateways in the API
+const siteAll = "all"
+
+var siteNameRe = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
+// site is a gateway polled by the daemon, each one has its own session, data
+// and poll loop
+type site struct {
+	app  *AppServer
+	name string
+
+	gateway *envoy.Envoy
+	session *envoy.Session
+	data    *snapshotStore
+	stats   pollStats
+	mqtt    *mqttPublisher
+	history historyRecorder
+
+	inverterFlags inverterFlags
+}
+
+// siteNames returns the gateways of the gateways section of the config,
+// sorted by name. Without that section, there is only the default gateway.
+func siteNames() ([]string, error) {
+	names := config.Config.MapKeys("gateways")
+	if len(names) == 0 {
+		return []string{envoy.DefaultGateway}, nil
+	}
+
+	for _, n := range names {
+		if !siteNameRe.MatchString(n) || n == siteAll {
+			return nil, fmt.Errorf("invalid gateway name %q", n)
+		}
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// newSite creates a gateway from its section in the config. Host, serial and
+// account can be set there, otherwise they come from the cache and the
+// environment like for the command line tool.
+func (a *AppServer) newSite(name string, multi bool) (s *site, err error) {
+	key := "gateways." + name + "."
+
+	path := config.Config.String(key + "store_path")
+	if path == "" && name == envoy.DefaultGateway {
+		path = config.Config.String("store.path")
+	}
+
+	store, err := newCredentialStore(name, path)
+	if err != nil {
+		return
+	}
+
+	gateway, err := envoy.New(
+		envoy.WithStore(store),
+		envoy.WithHost(config.Config.String(key+"host")),
+		envoy.WithSerial(config.Config.String(key+"serial")),
+		envoy.WithCredentials(config.Config.String(key+"username"), config.Config.String(key+"password")),
+		envoy.WithRetryPolicy(envoy.RetryPolicy{
+			Attempts: config.Config.Int("retry.attempts"),
+			MinDelay: config.Config.Duration("retry.min_delay"),
+			MaxDelay: config.Config.Duration("retry.max_delay"),
+			Jitter:   config.Config.Float64("retry.jitter"),
+		}),
+		envoy.WithBreakerPolicy(envoy.BreakerPolicy{
+			Failures:   config.Config.Int("breaker.failures"),
+			OpenFor:    config.Config.Duration("breaker.open_for"),
+			MaxOpenFor: config.Config.Duration("breaker.max_open_for"),
+		}),
+	)
+	if err != nil {
+		return
+	}
+
+	s = &site{
+		app:     a,
+		name:    name,
+		gateway: gateway,
+		session: envoy.NewSession(gateway),
+		data:    newSnapshotStore(),
+	}
+
+	serial := gateway.Serial()
+	clientID := config.Config.String("mqtt.client_id")
+	if multi {
+		if serial == "" {
+			serial = name
+		}
+		clientID += "-" + name
+	}
+	if s.mqtt, err = newMqttPublisher(serial, clientID); err != nil {
+		return nil, err
+	}
+
+	return
+}
+
+// historySite returns the site name used in the history, the default gateway
+// keeps the series without prefix
+func (s *site) historySite() string {
+	if s.name == envoy.DefaultGateway {
+		return ""
+	}
+	return s.name
+}
+
+// site returns a gateway by name, nil if it does not exist
+func (a *AppServer) site(name string) *site {
+	for _, s := range a.sites {
+		if s.name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// primarySite returns the gateway served by the routes without gateway name.
+// It is general.gateway, the default gateway or the first one.
+func (a *AppServer) primarySite() *site {
+	if s := a.site(config.Config.String("general.gateway")); s != nil {
+		return s
+	}
+	if s := a.site(envoy.DefaultGateway); s != nil {
+		return s
+	}
+	return a.sites[0]
+}
+
+// siteHandler calls h with the gateway named in the route, or the primary one
+// for routes without gateway
+func (a *AppServer) siteHandler(h func(c *fiber.Ctx, s *site) error) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		name := c.Params("gateway")
+		if name == "" {
+			return h(c, a.primarySite())
+		}
+
+		s := a.site(name)
+		if s == nil {
+			return fiber.NewError(fiber.StatusNotFound, fmt.Sprintf("unknown gateway %q", name))
+		}
+		return h(c, s)
+	}
+}
+
+func (s *site) logger() *logrus.Entry {
+	return logging.WithField("gateway", s.name)
+}
@@ -0,0 +1,197 @@
+package app
+
+import (
+	"sync"
+	"time"
+
+	"github.com/raoulh/go-envoy/pkg/envoy"
+)
+
+const (
+	datasetProduction = "production"
+	datasetInventory  = "inventory"
+	datasetInverters  = "inverters"
+	datasetBattery    = "battery"
+	datasetMeters     = "meters"
+	datasetLiveData   = "livedata"
+)
+
+// datasetInfo tells when a dataset was last fetched
+type datasetInfo struct {
+	// Version is incremented on each successful fetch
+	Version   uint64     `json:"version"`
+	FetchedAt time.Time  `json:"fetched_at"`
+	LastError string     `json:"last_error,omitempty"`
+	ErrorAt   *time.Time `json:"error_at,omitempty"`
+
+	err error
+}
+
+// failing returns true if the last fetch of the dataset failed
+func (i *datasetInfo) failing() bool {
+	return i.err != nil && i.ErrorAt != nil && !i.ErrorAt.Before(i.FetchedAt)
+}
+
+// age returns how old the data is, it is -1 if it was never fetched
+func (i *datasetInfo) age(now time.Time) time.Duration {
+	if i.FetchedAt.IsZero() {
+		return -1
+	}
+	return now.Sub(i.FetchedAt)
+}
+
+// stale returns true if the data is older than maxAge or was never fetched.
+// A maxAge of 0 disables the check.
+func (i *datasetInfo) stale(now time.Time, maxAge time.Duration) bool {
+	if i.FetchedAt.IsZero() {
+		return true
+	}
+	return maxAge > 0 && i.age(now) > maxAge
+}
+
+// meterData is the configuration and the values of the CT meters, they are
+// matched by eid
+type meterData struct {
+	Meters   []envoy.Meter        `json:"meters"`
+	Readings []envoy.MeterReading `json:"readings"`
+}
+
+// snapshotStore keeps the last data read from the gateway. Values are
+// replaced on update and never modified, they can be used after the lock
+// is released.
+type snapshotStore struct {
+	mu sync.RWMutex
+
+	production envoy.Production
+	inventory  []envoy.Inventory
+	inverters  []envoy.Inverter
+	battery    envoy.BatteryStatus
+	meters     meterData
+	liveData   envoy.LiveData
+
+	info map[string]datasetInfo
+}
+
+func newSnapshotStore() *snapshotStore {
+	return &snapshotStore{
+		info: make(map[string]datasetInfo),
+	}
+}
+
+// fetched must be called with the lock held
+func (s *snapshotStore) fetched(dataset string) {
+	i := s.info[dataset]
+	i.Version++
+	i.FetchedAt = time.Now()
+	s.info[dataset] = i
+}
+
+func (s *snapshotStore) setProduction(p envoy.Production) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.production = p
+	s.fetched(datasetProduction)
+}
+
+func (s *snapshotStore) setInventory(inv []envoy.Inventory) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.inventory = inv
+	s.fetched(datasetInventory)
+}
+
+func (s *snapshotStore) setInverters(inv []envoy.Inverter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.inverters = inv
+	s.fetched(datasetInverters)
+}
+
+func (s *snapshotStore) setBattery(b envoy.BatteryStatus) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.battery = b
+	s.fetched(datasetBattery)
+}
+
+func (s *snapshotStore) setMeters(m meterData) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.meters = m
+	s.fetched(datasetMeters)
+}
+
+func (s *snapshotStore) setLiveData(d envoy.LiveData) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.liveData = d
+	s.fetched(datasetLiveData)
+}
+
+// setError records a failed fetch, the previous data is kept
+func (s *snapshotStore) setError(dataset string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.info[dataset]
+	i.LastError = err.Error()
+	i.err = err
+	now := time.Now()
+	i.ErrorAt = &now
+	s.info[dataset] = i
+}
+
+func (s *snapshotStore) getProduction() (envoy.Production, datasetInfo) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.production, s.info[datasetProduction]
+}
+
+func (s *snapshotStore) getInventory() ([]envoy.Inventory, datasetInfo) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.inventory, s.info[datasetInventory]
+}
+
+func (s *snapshotStore) getInverters() ([]envoy.Inverter, datasetInfo) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.inverters, s.info[datasetInverters]
+}
+
+func (s *snapshotStore) getBattery() (envoy.BatteryStatus, datasetInfo) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.battery, s.info[datasetBattery]
+}
+
+func (s *snapshotStore) getMeters() (meterData, datasetInfo) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.meters, s.info[datasetMeters]
+}
+
+func (s *snapshotStore) getLiveData() (envoy.LiveData, datasetInfo) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.liveData, s.info[datasetLiveData]
+}
+
+func (s *snapshotStore) getInfo(dataset string) datasetInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.info[dataset]
+}
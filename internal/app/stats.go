@@ -0,0 +1,56 @@
+package app
+
+import (
+	"sync"
+	"time"
+)
+
+// pollStats keeps track of the polling of the gateway
+type pollStats struct {
+	mu sync.Mutex
+
+	polls        uint64
+	pollErrors   uint64
+	lastDuration time.Duration
+	lastSuccess  time.Time
+	lastBeat     time.Time
+}
+
+func (s *pollStats) record(start time.Time, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+
+	s.polls++
+	s.lastDuration = now.Sub(start)
+	if ok {
+		s.lastSuccess = now
+	} else {
+		s.pollErrors++
+	}
+}
+
+// snapshot returns a copy of the stats without the lock
+func (s *pollStats) snapshot() (polls, pollErrors uint64, lastDuration time.Duration, lastSuccess time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.polls, s.pollErrors, s.lastDuration, s.lastSuccess
+}
+
+// beat is called on each iteration of the poll loop
+func (s *pollStats) beat() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastBeat = time.Now()
+}
+
+// lastBeatTime returns when the poll loop was last running
+func (s *pollStats) lastBeatTime() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.lastBeat
+}
@@ -0,0 +1,133 @@
+package app
+
+import (
+	"errors"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/raoulh/go-envoy/pkg/envoy"
+)
+
+type gatewayStatus struct {
+	Name      string `json:"name"`
+	Host      string `json:"host"`
+	Serial    string `json:"serial"`
+	Reachable bool   `json:"reachable"`
+	// CertFingerprint is the pinned certificate of the gateway
+	CertFingerprint string `json:"cert_fingerprint,omitempty"`
+	LastError       string `json:"last_error,omitempty"`
+}
+
+type breakerStatus struct {
+	State     envoy.BreakerState `json:"state"`
+	Failures  int                `json:"failures"`
+	OpenUntil *time.Time         `json:"open_until,omitempty"`
+	LastError string             `json:"last_error,omitempty"`
+}
+
+type authStatus struct {
+	Authenticated         bool          `json:"authenticated"`
+	TokenExpiresAt        *time.Time    `json:"token_expires_at,omitempty"`
+	TokenExpiresInSeconds float64       `json:"token_expires_in_seconds"`
+	Breaker               breakerStatus `json:"breaker"`
+}
+
+type datasetStatus struct {
+	datasetInfo
+	AgeSeconds float64 `json:"age_seconds"`
+	MaxAge     string  `json:"max_age"`
+	Stale      bool    `json:"stale"`
+}
+
+type pollStatus struct {
+	Polls               uint64    `json:"polls"`
+	Errors              uint64    `json:"errors"`
+	LastDurationSeconds float64   `json:"last_duration_seconds"`
+	LastSuccess         time.Time `json:"last_success"`
+}
+
+type statusResponse struct {
+	Gateway  gatewayStatus            `json:"gateway"`
+	Auth     authStatus               `json:"auth"`
+	Datasets map[string]datasetStatus `json:"datasets"`
+	Poll     pollStatus               `json:"poll"`
+}
+
+// gatewayReachable returns true if the gateway answered the last request, even
+// if authentication was refused
+func gatewayReachable(info *datasetInfo) bool {
+	if info.failing() {
+		return errors.Is(info.err, envoy.ErrUnauthorized) ||
+			errors.Is(info.err, envoy.ErrUnexpectedResponse)
+	}
+	return !info.FetchedAt.IsZero()
+}
+
+func (s *site) status() statusResponse {
+	now := time.Now()
+
+	prod := s.data.getInfo(datasetProduction)
+
+	r := statusResponse{
+		Gateway: gatewayStatus{
+			Name:      s.name,
+			Host:      s.gateway.Host(),
+			Serial:    s.gateway.Serial(),
+			Reachable: gatewayReachable(&prod),
+
+			CertFingerprint: s.gateway.Credentials().CertFingerprint,
+		},
+		Auth: authStatus{
+			Authenticated: s.session.Authenticated(),
+		},
+		Datasets: make(map[string]datasetStatus),
+	}
+
+	if prod.failing() {
+		r.Gateway.LastError = prod.LastError
+	}
+
+	if t := s.gateway.TokenExpiresAt(); !t.IsZero() {
+		r.Auth.TokenExpiresAt = &t
+		r.Auth.TokenExpiresInSeconds = t.Sub(now).Seconds()
+	}
+
+	b := s.gateway.BreakerStatus()
+	r.Auth.Breaker = breakerStatus{
+		State:     b.State,
+		Failures:  b.Failures,
+		LastError: b.LastError,
+	}
+	if !b.OpenUntil.IsZero() {
+		r.Auth.Breaker.OpenUntil = &b.OpenUntil
+	}
+
+	for _, name := range s.datasets() {
+		info := s.data.getInfo(name)
+		maxAge := s.maxDataAge(name)
+		ds := datasetStatus{
+			datasetInfo: info,
+			MaxAge:      maxAge.String(),
+			Stale:       info.stale(now, maxAge),
+		}
+		if age := info.age(now); age >= 0 {
+			ds.AgeSeconds = age.Seconds()
+		}
+		r.Datasets[name] = ds
+	}
+
+	polls, pollErrors, lastDuration, lastSuccess := s.stats.snapshot()
+	r.Poll = pollStatus{
+		Polls:               polls,
+		Errors:              pollErrors,
+		LastDurationSeconds: lastDuration.Seconds(),
+		LastSuccess:         lastSuccess,
+	}
+
+	return r
+}
+
+// apiStatus summarises the state of the gateway and of the data
+func apiStatus(c *fiber.Ctx, s *site) error {
+	return c.JSON(s.status())
+}
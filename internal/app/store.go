@@ -0,0 +1,16 @@
+package app
+
+import (
+	"github.com/raoulh/go-envoy/internal/config"
+	"github.com/raoulh/go-envoy/pkg/envoy"
+)
+
+// newCredentialStore creates the store for credentials and token of a gateway
+// from the config. path defaults to the cache file of the gateway. The store
+// is the same as the one of the command line tool, which reads the type and
+// passphrase from ENVOY_STORE_TYPE and ENVOY_STORE_PASSPHRASE.
+func newCredentialStore(gateway, path string) (envoy.CredentialStore, error) {
+	return envoy.NewCacheStore(gateway, path,
+		config.Config.String("store.type"),
+		config.Config.String("store.passphrase"))
+}
@@ -8,6 +8,8 @@ import (
 
 func (a *AppServer) homePage(c *fiber.Ctx) error {
 	type Data struct {
+		Gateway string
+
 		ProdNow  string
 		ConsoNow string
 		NetNow   string
@@ -17,7 +19,9 @@ func (a *AppServer) homePage(c *fiber.Ctx) error {
 		NetToday   string
 	}
 
-	d := Data{}
+	s := a.primarySite()
+	d := Data{Gateway: s.name}
+	production, _ := s.production()
 
 	for _, v := range production.Production {
 		if v.MeasurementType == "production" {
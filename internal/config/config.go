@@ -20,9 +20,47 @@ var Config = koanf.New(".")
 
 var (
 	defaultConfig map[string]interface{} = map[string]interface{}{
-		"general.port":    8000,
-		"general.address": "",
-		"log.default":     "trace",
+		"general.port":             8000,
+		"general.address":          "",
+		"general.max_data_age":     "2m",
+		"general.gateway":          "",
+		"log.default":              "trace",
+		"store.type":               "file",
+		"mqtt.enabled":             false,
+		"mqtt.broker":              "tcp://127.0.0.1:1883",
+		"mqtt.client_id":           "go-envoy",
+		"mqtt.topic_prefix":        "envoy",
+		"mqtt.discovery":           true,
+		"mqtt.discovery_prefix":    "homeassistant",
+		"poll.production":          "1s",
+		"poll.production_live":     "1m",
+		"poll.livedata":            "1s",
+		"poll.inverters":           "1m",
+		"poll.inventory":           "5m",
+		"poll.battery":             "30s",
+		"poll.meters":              "10s",
+		"poll.jitter":              0.1,
+		"poll.backoff_max":         "5m",
+		"poll.night_interval":      "0",
+		"retry.attempts":           3,
+		"retry.min_delay":          "200ms",
+		"retry.max_delay":          "2s",
+		"retry.jitter":             0.2,
+		"breaker.failures":         3,
+		"breaker.open_for":         "1m",
+		"breaker.max_open_for":     "1h",
+		"health.ready_max_age":     "1m",
+		"health.unready_restart":   "15m",
+		"health.sd_notify":         true,
+		"history.enabled":          true,
+		"history.retention_raw":    "48h",
+		"history.retention_5m":     "2160h",
+		"history.retention_hourly": "0",
+		"history.flush_interval":   "30s",
+		"history.sample_interval":  "10s",
+		"inverters.days":           7,
+		"inverters.min_ratio":      0.8,
+		"inverters.flag_days":      3,
 	}
 
 	//a dedicated logger must be used here to avoid conflict
@@ -0,0 +1,495 @@
+package models
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/raoulh/go-envoy/internal/config"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Resolution of the stored points
+type Resolution string
+
+const (
+	ResolutionRaw    Resolution = "raw"
+	Resolution5Min   Resolution = "5m"
+	ResolutionHourly Resolution = "1h"
+)
+
+const (
+	downsampleInterval = time.Minute
+
+	//samples further apart than that are not integrated together, inverters
+	//report every 5 minutes and are only recorded when they do
+	maxSampleGap         = 5 * time.Minute
+	maxInverterSampleGap = 15 * time.Minute
+
+	//samples are written at once when that many are waiting
+	maxPendingSamples = 300
+
+	SeriesProduction  = "production"
+	SeriesConsumption = "consumption"
+	SeriesNet         = "net"
+	SeriesInverter    = "inverter/"
+)
+
+var (
+	bucketMeta = []byte("meta")
+
+	//samples recorded but not written yet
+	pendingMu sync.Mutex
+	pending   []pendingSample
+
+	// ErrHistoryDisabled is returned when history is not enabled in config
+	ErrHistoryDisabled = errors.New("history is disabled")
+)
+
+// Duration of a point for each resolution
+func (r Resolution) Duration() time.Duration {
+	switch r {
+	case Resolution5Min:
+		return 5 * time.Minute
+	case ResolutionHourly:
+		return time.Hour
+	}
+	return 0
+}
+
+func (r Resolution) bucket() []byte {
+	return []byte(r)
+}
+
+// retention returns how long points are kept, 0 means forever
+func (r Resolution) retention() time.Duration {
+	switch r {
+	case ResolutionRaw:
+		return config.Config.Duration("history.retention_raw")
+	case Resolution5Min:
+		return config.Config.Duration("history.retention_5m")
+	}
+	return config.Config.Duration("history.retention_hourly")
+}
+
+// Sample is the data read during one poll, values are in W. The production,
+// consumption and net power are only recorded if HasPower is set. Inverters
+// are indexed by serial number. Site is the gateway the sample was read from,
+// empty for the default one.
+type Sample struct {
+	Site        string
+	Time        time.Time
+	HasPower    bool
+	Production  float64
+	Consumption float64
+	Net         float64
+	Inverters   map[string]float64
+}
+
+// series returns the values of the sample by series name
+func (s *Sample) series() map[string]float64 {
+	m := make(map[string]float64, len(s.Inverters)+3)
+	if s.HasPower {
+		m[SeriesProduction] = s.Production
+		m[SeriesConsumption] = s.Consumption
+		m[SeriesNet] = s.Net
+	}
+	for sn, w := range s.Inverters {
+		m[SeriesInverter+sn] = w
+	}
+	if s.Site == "" {
+		return m
+	}
+
+	sm := make(map[string]float64, len(m))
+	for name, v := range m {
+		sm[SiteSeries(s.Site, name)] = v
+	}
+	return sm
+}
+
+// SiteSeries returns the name of a series for a site, series of the default
+// site are not prefixed
+func SiteSeries(site, series string) string {
+	if site == "" {
+		return series
+	}
+	return site + "/" + series
+}
+
+// sampleGap returns how long a sample of a series is held at most
+func sampleGap(series string) time.Duration {
+	if strings.HasPrefix(series, SeriesInverter) || strings.Contains(series, "/"+SeriesInverter) {
+		return maxInverterSampleGap
+	}
+	return maxSampleGap
+}
+
+// storedPoint is the aggregation of a series over a period. Raw samples only
+// have an average. Energy is in Wh, integrated from the power samples over
+// Secs seconds, the average is weighted by the time each sample is held.
+type storedPoint struct {
+	Avg   float64 `json:"a"`
+	Min   float64 `json:"mn,omitempty"`
+	Max   float64 `json:"mx,omitempty"`
+	Count int     `json:"c,omitempty"`
+	Wh    float64 `json:"wh,omitempty"`
+	Secs  float64 `json:"s,omitempty"`
+
+	//span is the time covered by a point read in a query, from its time
+	span time.Duration
+}
+
+// record stored in the buckets, one per timestamp with all series
+type storedPoints map[string]storedPoint
+
+// pendingSample is a raw record waiting to be written
+type pendingSample struct {
+	key   []byte
+	value []byte
+}
+
+func timeKey(t time.Time) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, uint64(t.UnixNano()))
+	return k
+}
+
+func keyTime(k []byte) time.Time {
+	return time.Unix(0, int64(binary.BigEndian.Uint64(k)))
+}
+
+func initHistory() error {
+	return db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{bucketMeta, ResolutionRaw.bucket(), Resolution5Min.bucket(), ResolutionHourly.bucket()} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Record stores a sample in the raw history. Samples are buffered and written
+// together every history.flush_interval, a write per poll would sync the
+// database every second.
+func Record(s *Sample) error {
+	if db == nil {
+		return ErrHistoryDisabled
+	}
+
+	points := make(storedPoints)
+	for name, v := range s.series() {
+		points[name] = storedPoint{Avg: v}
+	}
+	if len(points) == 0 {
+		return nil
+	}
+
+	b, err := json.Marshal(points)
+	if err != nil {
+		return err
+	}
+
+	pendingMu.Lock()
+	pending = append(pending, pendingSample{key: timeKey(s.Time), value: b})
+	full := len(pending) >= maxPendingSamples
+	pendingMu.Unlock()
+
+	if full {
+		return flush()
+	}
+	return nil
+}
+
+// flush writes the buffered samples in one transaction. They are dropped if
+// the write fails.
+func flush() error {
+	pendingMu.Lock()
+	batch := pending
+	pending = nil
+	pendingMu.Unlock()
+
+	if len(batch) == 0 {
+		return nil
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(ResolutionRaw.bucket())
+		for _, p := range batch {
+			if err := b.Put(p.key, p.value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// load returns the points of a resolution in [from, to)
+func load(tx *bolt.Tx, r Resolution, from, to time.Time) (times []time.Time, points []storedPoints, err error) {
+	c := tx.Bucket(r.bucket()).Cursor()
+	end := timeKey(to)
+
+	for k, v := c.Seek(timeKey(from)); k != nil && string(k) < string(end); k, v = c.Next() {
+		var p storedPoints
+		if err = json.Unmarshal(v, &p); err != nil {
+			return
+		}
+		for name, sp := range p {
+			if sp.Count == 0 {
+				p[name] = storedPoint{Avg: sp.Avg, Min: sp.Avg, Max: sp.Avg, Count: 1}
+			}
+		}
+		times = append(times, keyTime(k))
+		points = append(points, p)
+	}
+
+	return
+}
+
+// holdDurations returns how long each sample of each series is held: until
+// the next sample of the same series, up to its sampleGap, or until end if
+// there is none. Series of other sites recorded in between do not count.
+func holdDurations(times []time.Time, points []storedPoints, end time.Time) []map[string]time.Duration {
+	res := make([]map[string]time.Duration, len(points))
+	next := make(map[string]time.Time)
+
+	for i := len(points) - 1; i >= 0; i-- {
+		res[i] = make(map[string]time.Duration, len(points[i]))
+		for name := range points[i] {
+			n, ok := next[name]
+			if !ok {
+				n = end
+			}
+			dt := n.Sub(times[i])
+			if gap := sampleGap(name); dt > gap {
+				dt = gap
+			}
+			if dt < 0 {
+				dt = 0
+			}
+			res[i][name] = dt
+			next[name] = times[i]
+		}
+	}
+
+	return res
+}
+
+// aggregate merges the points before end of a finer resolution into one point
+// per series. Raw points are integrated to get the energy, see holdDurations,
+// the points after end are only used to integrate the last ones. The average
+// is weighted by the time covered by each point.
+func aggregate(times []time.Time, points []storedPoints, end time.Time, raw bool) storedPoints {
+	out := make(storedPoints)
+
+	var hold []map[string]time.Duration
+	if raw {
+		hold = holdDurations(times, points, end)
+	}
+
+	for i, pts := range points {
+		if !times[i].Before(end) {
+			break
+		}
+
+		for name, p := range pts {
+			a, ok := out[name]
+			if !ok {
+				a = storedPoint{Min: math.Inf(1), Max: math.Inf(-1)}
+			}
+
+			a.Avg += p.Avg * float64(p.Count)
+			a.Min = math.Min(a.Min, p.Min)
+			a.Max = math.Max(a.Max, p.Max)
+			a.Count += p.Count
+			if raw {
+				a.Wh += p.Avg * hold[i][name].Hours()
+				a.Secs += hold[i][name].Seconds()
+			} else {
+				a.Wh += p.Wh
+				a.Secs += p.Secs
+			}
+
+			out[name] = a
+		}
+	}
+
+	for name, a := range out {
+		a.Avg = weightedAvg(a.Avg, a.Count, a.Wh, a.Secs)
+		out[name] = a
+	}
+
+	return out
+}
+
+// weightedAvg returns the average power over secs from the energy wh, or the
+// average of count points summing to sum when the time covered is not known,
+// for points recorded before it was stored
+func weightedAvg(sum float64, count int, wh, secs float64) float64 {
+	if secs > 0 {
+		return wh * 3600 / secs
+	}
+	if count > 0 {
+		return sum / float64(count)
+	}
+	return 0
+}
+
+func lastDownsampled(tx *bolt.Tx, r Resolution) time.Time {
+	v := tx.Bucket(bucketMeta).Get([]byte("downsampled/" + string(r)))
+	if v == nil {
+		return time.Time{}
+	}
+	return keyTime(v)
+}
+
+// downsample aggregates all complete periods of dst from the points of src
+// that were not processed yet
+func downsample(src, dst Resolution, now time.Time) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		period := dst.Duration()
+		start := lastDownsampled(tx, dst)
+
+		if start.IsZero() {
+			//start with the oldest point available
+			k, _ := tx.Bucket(src.bucket()).Cursor().First()
+			if k == nil {
+				return nil
+			}
+			start = keyTime(k).Truncate(period)
+		}
+
+		dstBucket := tx.Bucket(dst.bucket())
+		srcCursor := tx.Bucket(src.bucket()).Cursor()
+
+		for !start.Add(period).After(now) {
+			end := start.Add(period)
+
+			//the next raw samples are needed to integrate the last ones
+			loadEnd := end
+			if src == ResolutionRaw {
+				loadEnd = end.Add(maxInverterSampleGap)
+			}
+
+			times, points, err := load(tx, src, start, loadEnd)
+			if err != nil {
+				return err
+			}
+
+			if len(times) == 0 || !times[0].Before(end) {
+				//jump to the period of the next point
+				k, _ := srcCursor.Seek(timeKey(end))
+				if k == nil {
+					end = now.Truncate(period)
+				} else if next := keyTime(k).Truncate(period); next.After(end) {
+					end = next
+				}
+			} else {
+				b, err := json.Marshal(aggregate(times, points, end, src == ResolutionRaw))
+				if err != nil {
+					return err
+				}
+				if err = dstBucket.Put(timeKey(start), b); err != nil {
+					return err
+				}
+			}
+
+			if err = tx.Bucket(bucketMeta).Put([]byte("downsampled/"+string(dst)), timeKey(end)); err != nil {
+				return err
+			}
+
+			start = end
+		}
+
+		return nil
+	})
+}
+
+// prune removes the points older than the retention of their resolution
+func prune(r Resolution, now time.Time) error {
+	ret := r.retention()
+	if ret <= 0 {
+		return nil
+	}
+
+	limit := timeKey(now.Add(-ret))
+
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(r.bucket())
+
+		//deleting while iterating with a cursor skips keys, collect them first
+		var keys [][]byte
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil && string(k) < string(limit); k, _ = c.Next() {
+			keys = append(keys, k)
+		}
+
+		for _, k := range keys {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func runDownsampling() {
+	defer wgDone.Done()
+
+	for {
+		now := time.Now()
+
+		//the buffered samples are needed to downsample the last periods
+		if err := flush(); err != nil {
+			logging.Errorf("Failed to write history: %v", err)
+		}
+
+		if err := downsample(ResolutionRaw, Resolution5Min, now); err != nil {
+			logging.Errorf("Failed to downsample to 5 minutes: %v", err)
+		}
+		if err := downsample(Resolution5Min, ResolutionHourly, now); err != nil {
+			logging.Errorf("Failed to downsample to hourly: %v", err)
+		}
+
+		for _, r := range []Resolution{ResolutionRaw, Resolution5Min, ResolutionHourly} {
+			if err := prune(r, now); err != nil {
+				logging.Errorf("Failed to prune %s history: %v", r, err)
+			}
+		}
+
+		select {
+		case <-quitRefresh:
+			logging.Debugln("exiting downsampling routine")
+			return
+		case <-time.After(downsampleInterval):
+		}
+	}
+}
+
+// runFlush writes the buffered samples every history.flush_interval
+func runFlush() {
+	defer wgDone.Done()
+
+	interval := config.Config.Duration("history.flush_interval")
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+
+	for {
+		select {
+		case <-quitRefresh:
+			logging.Debugln("exiting history flush routine")
+			return
+		case <-time.After(interval):
+		}
+
+		if err := flush(); err != nil {
+			logging.Errorf("Failed to write history: %v", err)
+		}
+	}
+}
@@ -0,0 +1,459 @@
+package models
+
+import (
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var t0 = time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+
+func raw(v float64) storedPoint {
+	return storedPoint{Avg: v, Min: v, Max: v, Count: 1}
+}
+
+// openTestDB opens an empty history in a temporary directory
+func openTestDB(t *testing.T) {
+	var err error
+	db, err = bolt.Open(filepath.Join(t.TempDir(), "history.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = initHistory(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		db.Close()
+		db = nil
+		pending = nil
+	})
+}
+
+func TestHoldDurations(t *testing.T) {
+	tests := []struct {
+		name   string
+		times  []time.Time
+		points []storedPoints
+		end    time.Time
+		want   []map[string]time.Duration
+	}{
+		{
+			name:   "until next sample",
+			times:  []time.Time{t0, t0.Add(time.Second)},
+			points: []storedPoints{{"a": raw(1)}, {"a": raw(2)}},
+			end:    t0.Add(3 * time.Second),
+			want:   []map[string]time.Duration{{"a": time.Second}, {"a": 2 * time.Second}},
+		},
+		{
+			name:   "gap is capped",
+			times:  []time.Time{t0, t0.Add(10 * time.Minute)},
+			points: []storedPoints{{"a": raw(1)}, {"a": raw(2)}},
+			end:    t0.Add(time.Hour),
+			want:   []map[string]time.Duration{{"a": maxSampleGap}, {"a": maxSampleGap}},
+		},
+		{
+			name:  "several series",
+			times: []time.Time{t0, t0.Add(time.Second), t0.Add(3 * time.Second)},
+			points: []storedPoints{
+				{"a": raw(1), "b": raw(1)},
+				{"a": raw(1)},
+				{"b": raw(1)},
+			},
+			end: t0.Add(4 * time.Second),
+			want: []map[string]time.Duration{
+				{"a": time.Second, "b": 3 * time.Second},
+				{"a": 3 * time.Second},
+				{"b": time.Second},
+			},
+		},
+		{
+			name:   "next sample after end",
+			times:  []time.Time{t0, t0.Add(2 * time.Second)},
+			points: []storedPoints{{"a": raw(1)}, {"a": raw(2)}},
+			end:    t0.Add(time.Second),
+			want:   []map[string]time.Duration{{"a": 2 * time.Second}, {"a": 0}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := holdDurations(tt.times, tt.points, tt.end)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d durations, want %d", len(got), len(tt.want))
+			}
+			for i := range got {
+				for name, d := range tt.want[i] {
+					if got[i][name] != d {
+						t.Errorf("point %d series %s: got %v, want %v", i, name, got[i][name], d)
+					}
+				}
+				if len(got[i]) != len(tt.want[i]) {
+					t.Errorf("point %d: got %v, want %v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	tests := []struct {
+		name   string
+		times  []time.Time
+		points []storedPoints
+		end    time.Time
+		raw    bool
+		want   storedPoints
+	}{
+		{
+			name:   "raw samples",
+			times:  []time.Time{t0, t0.Add(30 * time.Minute), t0.Add(35 * time.Minute)},
+			points: []storedPoints{{"a": raw(1000)}, {"a": raw(2000)}, {"a": raw(3000)}},
+			end:    t0.Add(time.Hour),
+			raw:    true,
+			//1000W held 5min (gap), 2000W held 5min, 3000W held 5min
+			want: storedPoints{"a": {Avg: 2000, Min: 1000, Max: 3000, Count: 3, Wh: 500, Secs: 900}},
+		},
+		{
+			name:   "raw samples with lookahead",
+			times:  []time.Time{t0, t0.Add(time.Minute), t0.Add(2 * time.Minute)},
+			points: []storedPoints{{"a": raw(600)}, {"a": raw(1200)}, {"a": raw(6000)}},
+			end:    t0.Add(2 * time.Minute),
+			raw:    true,
+			want:   storedPoints{"a": {Avg: 900, Min: 600, Max: 1200, Count: 2, Wh: 30, Secs: 120}},
+		},
+		{
+			name:  "raw samples of several series",
+			times: []time.Time{t0, t0.Add(time.Minute), t0.Add(3 * time.Minute)},
+			points: []storedPoints{
+				{"a": raw(600), "b": raw(60)},
+				{"b": raw(120)},
+				{"a": raw(0)},
+			},
+			end: t0.Add(4 * time.Minute),
+			raw: true,
+			//averages are weighted by time: a is 600W for 3 of the 4 minutes
+			want: storedPoints{
+				"a": {Avg: 450, Min: 0, Max: 600, Count: 2, Wh: 30, Secs: 240},
+				"b": {Avg: 105, Min: 60, Max: 120, Count: 2, Wh: 7, Secs: 240},
+			},
+		},
+		{
+			name:  "inverter samples",
+			times: []time.Time{t0, t0.Add(5*time.Minute + 10*time.Second), t0.Add(time.Hour)},
+			points: []storedPoints{
+				{SeriesInverter + "1": raw(120)},
+				{SeriesInverter + "1": raw(240)},
+				{"barn/" + SeriesInverter + "1": raw(60)},
+			},
+			end: t0.Add(time.Hour),
+			raw: true,
+			//inverters report every 5 minutes, their samples are held longer
+			want: storedPoints{
+				SeriesInverter + "1": {Avg: (120*310 + 240*900) / 1210.0, Min: 120, Max: 240, Count: 2, Wh: (120*310 + 240*900) / 3600.0, Secs: 1210},
+			},
+		},
+		{
+			name:  "downsampled points",
+			times: []time.Time{t0, t0.Add(5 * time.Minute)},
+			points: []storedPoints{
+				{"a": {Avg: 120, Min: 50, Max: 200, Count: 1, Wh: 10, Secs: 300}},
+				{"a": {Avg: 360, Min: 300, Max: 500, Count: 30, Wh: 6, Secs: 60}},
+			},
+			end: t0.Add(time.Hour),
+			//weighted by the time covered, not by the number of samples
+			want: storedPoints{"a": {Avg: 160, Min: 50, Max: 500, Count: 31, Wh: 16, Secs: 360}},
+		},
+		{
+			name:  "downsampled points without time",
+			times: []time.Time{t0, t0.Add(5 * time.Minute)},
+			points: []storedPoints{
+				{"a": {Avg: 100, Min: 50, Max: 200, Count: 1, Wh: 10}},
+				{"a": {Avg: 400, Min: 300, Max: 500, Count: 3, Wh: 30}},
+			},
+			end:  t0.Add(time.Hour),
+			want: storedPoints{"a": {Avg: 325, Min: 50, Max: 500, Count: 4, Wh: 40}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := aggregate(tt.times, tt.points, tt.end, tt.raw)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for name, w := range tt.want {
+				g := got[name]
+				if g.Count != w.Count || g.Min != w.Min || g.Max != w.Max || g.Secs != w.Secs ||
+					math.Abs(g.Avg-w.Avg) > 1e-9 || math.Abs(g.Wh-w.Wh) > 1e-9 {
+					t.Errorf("series %s: got %+v, want %+v", name, g, w)
+				}
+			}
+		})
+	}
+}
+
+func TestCollectRaw(t *testing.T) {
+	openTestDB(t)
+
+	samples := []Sample{
+		{Time: t0, HasPower: true, Production: 600},
+		{Site: "barn", Time: t0.Add(time.Second), HasPower: true, Production: 100},
+		{Time: t0.Add(time.Minute), HasPower: true, Production: 1200},
+		{Site: "barn", Time: t0.Add(time.Minute + time.Second), HasPower: true, Production: 100},
+		//after a gap, only maxSampleGap of the previous sample is counted
+		{Time: t0.Add(time.Hour), HasPower: true, Production: 0},
+		{Time: t0.Add(time.Hour + time.Minute), HasPower: true, Production: 6000},
+	}
+	for i := range samples {
+		if err := Record(&samples[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		series string
+		to     time.Time
+		times  []time.Time
+		wh     []float64
+	}{
+		{
+			name:   "default site",
+			series: SeriesProduction,
+			to:     t0.Add(time.Hour + time.Minute),
+			times:  []time.Time{t0, t0.Add(time.Minute), t0.Add(time.Hour)},
+			wh:     []float64{10, 100, 0},
+		},
+		{
+			name:   "other site",
+			series: SiteSeries("barn", SeriesProduction),
+			to:     t0.Add(2 * time.Minute),
+			times:  []time.Time{t0.Add(time.Second), t0.Add(time.Minute + time.Second)},
+			wh:     []float64{100.0 / 60, 100.0 / 60 * (59.0 / 60)},
+		},
+		{
+			name:   "unknown series",
+			series: SeriesNet + "x",
+			to:     t0.Add(2 * time.Hour),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := db.View(func(tx *bolt.Tx) error {
+				times, points, err := collectRaw(tx, []string{tt.series}, t0, tt.to)
+				if err != nil {
+					return err
+				}
+
+				if len(times) != len(tt.times) {
+					t.Fatalf("got %d points, want %d", len(times), len(tt.times))
+				}
+				for i := range times {
+					if !times[i].Equal(tt.times[i]) {
+						t.Errorf("point %d: got time %v, want %v", i, times[i], tt.times[i])
+					}
+					if wh := points[i][tt.series].Wh; math.Abs(wh-tt.wh[i]) > 1e-9 {
+						t.Errorf("point %d: got %vWh, want %vWh", i, wh, tt.wh[i])
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestSpread(t *testing.T) {
+	//midnights of a zone with a half hour offset
+	ist := time.FixedZone("IST", 5*3600+1800)
+	day := time.Date(2023, 6, 1, 0, 0, 0, 0, ist)
+	bounds := []time.Time{day, day.AddDate(0, 0, 1), day.AddDate(0, 0, 2)}
+
+	tests := []struct {
+		name  string
+		start time.Time
+		span  time.Duration
+		wh    float64
+		want  []float64
+	}{
+		{
+			name:  "inside a day",
+			start: day.Add(time.Hour),
+			span:  time.Hour,
+			wh:    100,
+			want:  []float64{100, 0},
+		},
+		{
+			name:  "hourly point over midnight",
+			start: day.AddDate(0, 0, 1).Add(-30 * time.Minute),
+			span:  time.Hour,
+			wh:    100,
+			want:  []float64{50, 50},
+		},
+		{
+			name:  "point starting before the first bound",
+			start: day.Add(-45 * time.Minute),
+			span:  time.Hour,
+			wh:    100,
+			want:  []float64{25, 0},
+		},
+		{
+			name:  "point after the last bound",
+			start: day.AddDate(0, 0, 2),
+			span:  time.Hour,
+			wh:    100,
+			want:  []float64{0, 0},
+		},
+		{
+			name:  "point without span",
+			start: day.AddDate(0, 0, 1),
+			wh:    100,
+			want:  []float64{0, 100},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := make([]float64, len(bounds)-1)
+			spread(got, bounds, tt.start, tt.span, tt.wh)
+			for i := range got {
+				if math.Abs(got[i]-tt.want[i]) > 1e-9 {
+					t.Errorf("got %v, want %v", got, tt.want)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestAlignStart(t *testing.T) {
+	from := t0.Add(37*time.Minute + 12*time.Second)
+
+	tests := []struct {
+		name string
+		step time.Duration
+		r    Resolution
+		want time.Time
+	}{
+		{
+			name: "short raw step",
+			step: time.Minute,
+			r:    ResolutionRaw,
+			want: from,
+		},
+		{
+			name: "step",
+			step: 15 * time.Minute,
+			r:    Resolution5Min,
+			want: t0.Add(30 * time.Minute),
+		},
+		{
+			name: "resolution coarser than the step",
+			step: 5 * time.Minute,
+			r:    ResolutionHourly,
+			want: t0,
+		},
+		{
+			name: "short step on old data",
+			step: time.Minute,
+			r:    Resolution5Min,
+			want: t0.Add(35 * time.Minute),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := alignStart(from, tt.step, tt.r); !got.Equal(tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEnergy(t *testing.T) {
+	openTestDB(t)
+
+	ist := time.FixedZone("IST", 5*3600+1800)
+	day := time.Date(2023, 6, 1, 0, 0, 0, 0, ist)
+
+	//600W from 23:00 to 01:00 local time, on both sides of midnight
+	for m := 0; m < 120; m++ {
+		s := Sample{
+			Time:      day.Add(23*time.Hour + time.Duration(m)*time.Minute),
+			Inverters: map[string]float64{"1": 600, "2": 300},
+		}
+		if err := Record(&s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	bounds := []time.Time{day, day.AddDate(0, 0, 1), day.AddDate(0, 0, 2)}
+	got, err := Energy([]string{SeriesInverter + "1", SeriesInverter + "2", SeriesInverter + "3"}, bounds)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//the last sample is held maxInverterSampleGap
+	want := map[string][]float64{
+		SeriesInverter + "1": {600, 590 + 150},
+		SeriesInverter + "2": {300, 295 + 75},
+		SeriesInverter + "3": {0, 0},
+	}
+	for name, w := range want {
+		for i := range w {
+			if math.Abs(got[name][i]-w[i]) > 1e-9 {
+				t.Errorf("series %s: got %v, want %v", name, got[name], w)
+				break
+			}
+		}
+	}
+}
+
+func TestRecordBuffered(t *testing.T) {
+	openTestDB(t)
+
+	count := func() (n int) {
+		db.View(func(tx *bolt.Tx) error {
+			n = tx.Bucket(ResolutionRaw.bucket()).Stats().KeyN
+			return nil
+		})
+		return
+	}
+
+	for i := 0; i < maxPendingSamples-1; i++ {
+		if err := Record(&Sample{Time: t0.Add(time.Duration(i) * time.Second), HasPower: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := count(); n != 0 {
+		t.Fatalf("got %d samples written before the flush, want 0", n)
+	}
+
+	//nothing to record
+	if err := Record(&Sample{Time: t0.Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(pending); n != maxPendingSamples-1 {
+		t.Fatalf("got %d samples buffered, want %d", n, maxPendingSamples-1)
+	}
+
+	if err := Record(&Sample{Time: t0.Add(time.Hour), Inverters: map[string]float64{"1": 10}}); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(); n != maxPendingSamples {
+		t.Fatalf("got %d samples written when the buffer is full, want %d", n, maxPendingSamples)
+	}
+}
@@ -1,11 +1,16 @@
 package models
 
 import (
+	"os"
+	"path/filepath"
 	"sync"
+	"time"
 
+	"github.com/raoulh/go-envoy/internal/config"
 	logger "github.com/raoulh/go-envoy/internal/log"
 
 	"github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
 )
 
 var (
@@ -14,6 +19,8 @@ var (
 	quitRefresh  chan interface{}
 	wgDone       sync.WaitGroup
 	runningTasks sync.Map
+
+	db *bolt.DB
 )
 
 func init() {
@@ -22,9 +29,72 @@ func init() {
 
 // Init models
 func Init() (err error) {
+	if !config.Config.Bool("history.enabled") {
+		logging.Infoln("History is disabled")
+		return
+	}
+
+	path := config.Config.String("history.path")
+	if path == "" {
+		path = defaultDbPath()
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return
+	}
+
+	db, err = bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return
+	}
+
+	err = initHistory()
+	if err != nil {
+		db.Close()
+		db = nil
+		return
+	}
+
+	logging.Infoln("History stored in", path)
+
+	quitRefresh = make(chan interface{})
+	wgDone.Add(2)
+	go runDownsampling()
+	go runFlush()
+
 	return
 }
 
 // Shutdown models
 func Shutdown() {
+	if db == nil {
+		return
+	}
+
+	close(quitRefresh)
+	wgDone.Wait()
+
+	if err := flush(); err != nil {
+		logging.Errorf("Failed to write history: %v", err)
+	}
+
+	if err := db.Close(); err != nil {
+		logging.Errorf("Failed to close database: %v", err)
+	}
+	db = nil
+}
+
+func defaultDbPath() string {
+	path := os.Getenv("ENVOY_CACHE_PATH")
+	if path == "" {
+		if home, err := os.UserHomeDir(); err == nil && home != "" {
+			path = filepath.Join(home, ".cache", "envoy")
+		}
+	}
+	if path == "" {
+		path = "./"
+	}
+
+	return filepath.Join(path, "history.db")
 }
@@ -0,0 +1,272 @@
+package models
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// resolutions from the finest to the coarsest
+var resolutions = []Resolution{ResolutionRaw, Resolution5Min, ResolutionHourly}
+
+// Point is the aggregation of a series over one step of a query. Power values
+// are in W, Wh is the energy integrated from the power samples and Avg is
+// weighted by the time each sample covers.
+type Point struct {
+	Time  time.Time `json:"time"`
+	Avg   float64   `json:"avg"`
+	Min   float64   `json:"min"`
+	Max   float64   `json:"max"`
+	Count int       `json:"count"`
+	Wh    float64   `json:"wh"`
+}
+
+// queryResolution returns the coarsest resolution finer than step that still
+// has data at from
+func queryResolution(from time.Time, step time.Duration, now time.Time) Resolution {
+	res := ResolutionHourly
+
+	for i := len(resolutions) - 1; i >= 0; i-- {
+		r := resolutions[i]
+		ret := r.retention()
+		if ret > 0 && from.Before(now.Add(-ret)) {
+			break
+		}
+		res = r
+		if r.Duration() <= step {
+			break
+		}
+	}
+
+	return res
+}
+
+// collect returns the points of the given series in [from, to), records
+// without any of them are skipped. The part of the range not downsampled yet
+// is read from the finer resolution. Raw samples are converted to points
+// holding their energy. Each point covers its span from its time.
+func collect(tx *bolt.Tx, r Resolution, series []string, from, to time.Time) (times []time.Time, points []storedPoints, err error) {
+	if r == ResolutionRaw {
+		return collectRaw(tx, series, from, to)
+	}
+
+	end := to
+	covered := lastDownsampled(tx, r)
+	if covered.Before(end) {
+		end = covered
+	}
+
+	if from.Before(end) {
+		ts, pts, err := load(tx, r, from, end)
+		if err != nil {
+			return nil, nil, err
+		}
+		for i := range ts {
+			sp := make(storedPoints, len(series))
+			for _, name := range series {
+				if p, ok := pts[i][name]; ok {
+					p.span = r.Duration()
+					sp[name] = p
+				}
+			}
+			if len(sp) > 0 {
+				times = append(times, ts[i])
+				points = append(points, sp)
+			}
+		}
+	}
+
+	if end.Before(to) {
+		if end.Before(from) {
+			end = from
+		}
+
+		for i, fr := range resolutions {
+			if fr == r {
+				ft, fp, err := collect(tx, resolutions[i-1], series, end, to)
+				if err != nil {
+					return nil, nil, err
+				}
+				times = append(times, ft...)
+				points = append(points, fp...)
+				break
+			}
+		}
+	}
+
+	return
+}
+
+func collectRaw(tx *bolt.Tx, series []string, from, to time.Time) (times []time.Time, points []storedPoints, err error) {
+	//the next samples are needed to integrate the last ones
+	ts, pts, err := load(tx, ResolutionRaw, from, to.Add(maxInverterSampleGap))
+	if err != nil {
+		return
+	}
+	hold := holdDurations(ts, pts, to)
+
+	for i := range ts {
+		if !ts[i].Before(to) {
+			break
+		}
+
+		sp := make(storedPoints, len(series))
+		for _, name := range series {
+			p, ok := pts[i][name]
+			if !ok {
+				continue
+			}
+			p.Wh = p.Avg * hold[i][name].Hours()
+			p.Secs = hold[i][name].Seconds()
+			p.span = hold[i][name]
+			sp[name] = p
+		}
+		if len(sp) > 0 {
+			times = append(times, ts[i])
+			points = append(points, sp)
+		}
+	}
+
+	return
+}
+
+// spread adds the energy wh of a point covering span from start to the
+// periods between bounds, in proportion of the time spent in each one
+func spread(energy []float64, bounds []time.Time, start time.Time, span time.Duration, wh float64) {
+	end := start.Add(span)
+
+	//first period ending after start
+	i := sort.Search(len(bounds)-1, func(i int) bool {
+		return bounds[i+1].After(start)
+	})
+
+	if span <= 0 {
+		if i < len(bounds)-1 && !start.Before(bounds[i]) {
+			energy[i] += wh
+		}
+		return
+	}
+
+	for ; i < len(bounds)-1 && bounds[i].Before(end); i++ {
+		from, to := bounds[i], bounds[i+1]
+		if start.After(from) {
+			from = start
+		}
+		if end.Before(to) {
+			to = end
+		}
+		if to.After(from) {
+			energy[i] += wh * float64(to.Sub(from)) / float64(span)
+		}
+	}
+}
+
+// Energy returns the energy in Wh of each series in each period between two
+// bounds, len(bounds)-1 values per series. Bounds do not need to be aligned on
+// the stored points, like local midnights: a point over a bound is split in
+// proportion of the time on each side. All series are read in one pass.
+func Energy(series []string, bounds []time.Time) (map[string][]float64, error) {
+	if db == nil {
+		return nil, ErrHistoryDisabled
+	}
+
+	res := make(map[string][]float64, len(series))
+	for _, name := range series {
+		res[name] = make([]float64, len(bounds)-1)
+	}
+	if len(bounds) < 2 {
+		return res, nil
+	}
+
+	from, to := bounds[0], bounds[len(bounds)-1]
+	r := queryResolution(from, Resolution5Min.Duration(), time.Now())
+
+	err := db.View(func(tx *bolt.Tx) error {
+		//the point started before from may cover its beginning
+		times, points, err := collect(tx, r, series, from.Add(-r.Duration()), to)
+		if err != nil {
+			return err
+		}
+
+		for i, pts := range points {
+			for name, p := range pts {
+				spread(res[name], bounds, times[i], p.span, p.Wh)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// alignStart truncates from so that each step starts on a point of r. Old
+// data may only be kept at a resolution coarser than step, from is then
+// aligned on the resolution instead. Raw queries with short steps are not
+// aligned.
+func alignStart(from time.Time, step time.Duration, r Resolution) time.Time {
+	d := step
+	if r.Duration() > d {
+		d = r.Duration()
+	}
+	if d < Resolution5Min.Duration() {
+		return from
+	}
+	return from.Truncate(d)
+}
+
+// Query returns the points of a series in [from, to), aggregated by step. from
+// is aligned on the step, or on the resolution when it is coarser, see
+// alignStart. Steps without data are not returned. The resolution used to
+// compute the points is also returned.
+func Query(series string, from, to time.Time, step time.Duration) (res []Point, r Resolution, err error) {
+	if db == nil {
+		return nil, "", ErrHistoryDisabled
+	}
+
+	r = queryResolution(from, step, time.Now())
+	from = alignStart(from, step, r)
+
+	err = db.View(func(tx *bolt.Tx) error {
+		times, points, err := collect(tx, r, []string{series}, from, to)
+		if err != nil {
+			return err
+		}
+
+		var (
+			cur  *Point
+			secs float64
+		)
+		for i, pts := range points {
+			p := pts[series]
+			start := from.Add(times[i].Sub(from) / step * step)
+
+			if cur == nil || !cur.Time.Equal(start) {
+				if cur != nil {
+					cur.Avg = weightedAvg(cur.Avg, cur.Count, cur.Wh, secs)
+				}
+				res = append(res, Point{Time: start, Min: math.Inf(1), Max: math.Inf(-1)})
+				cur = &res[len(res)-1]
+				secs = 0
+			}
+
+			cur.Avg += p.Avg * float64(p.Count)
+			cur.Min = math.Min(cur.Min, p.Min)
+			cur.Max = math.Max(cur.Max, p.Max)
+			cur.Count += p.Count
+			cur.Wh += p.Wh
+			secs += p.Secs
+		}
+		if cur != nil {
+			cur.Avg = weightedAvg(cur.Avg, cur.Count, cur.Wh, secs)
+		}
+
+		return nil
+	})
+
+	return
+}
@@ -0,0 +1,73 @@
+// Package systemd implements the sd_notify protocol, it lets a service
+// started with Type=notify report its state and ping the watchdog.
+package systemd
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	// Ready tells systemd the service finished starting up
+	Ready = "READY=1"
+	// Stopping tells systemd the service is shutting down
+	Stopping = "STOPPING=1"
+	// Watchdog keeps the watchdog from restarting the service
+	Watchdog = "WATCHDOG=1"
+)
+
+// Enabled returns true if the service was started by systemd with a
+// notification socket
+func Enabled() bool {
+	return os.Getenv("NOTIFY_SOCKET") != ""
+}
+
+// Notify sends a state to systemd, like Ready or "STATUS=...". It returns
+// false without error if there is no notification socket.
+func Notify(state string) (bool, error) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return false, nil
+	}
+
+	//abstract socket
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	if _, err = conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Status returns a STATUS= message for Notify
+func Status(s string) string {
+	return "STATUS=" + s
+}
+
+// WatchdogInterval returns the watchdog timeout set with WatchdogSec, or 0
+// if the watchdog is not enabled for this process
+func WatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+
+	if s := os.Getenv("WATCHDOG_PID"); s != "" {
+		pid, err := strconv.Atoi(s)
+		if err != nil || pid != os.Getpid() {
+			return 0
+		}
+	}
+
+	return time.Duration(usec) * time.Microsecond
+}
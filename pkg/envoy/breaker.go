@@ -0,0 +1,157 @@
+package envoy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned instead of logging in on enlighten after too many
+// failed logins, until the breaker lets a new try through
+var ErrCircuitOpen = errors.New("enlighten login suspended after repeated failures")
+
+// BreakerState is the state of the enlighten login circuit breaker
+type BreakerState string
+
+const (
+	// BreakerClosed lets logins through
+	BreakerClosed BreakerState = "closed"
+	// BreakerOpen rejects logins until OpenUntil
+	BreakerOpen BreakerState = "open"
+	// BreakerHalfOpen lets one login through, its result closes or opens the
+	// breaker again
+	BreakerHalfOpen BreakerState = "half-open"
+)
+
+// BreakerPolicy sets when logins on enlighten are suspended
+type BreakerPolicy struct {
+	// Failures is the number of failed logins in a row that opens the
+	// breaker, 0 disables it
+	Failures int
+	// OpenFor is how long the breaker stays open the first time, it doubles
+	// each time a try fails again
+	OpenFor time.Duration
+	// MaxOpenFor caps OpenFor
+	MaxOpenFor time.Duration
+}
+
+// DefaultBreakerPolicy is used when WithBreakerPolicy is not given
+var DefaultBreakerPolicy = BreakerPolicy{
+	Failures:   3,
+	OpenFor:    time.Minute,
+	MaxOpenFor: time.Hour,
+}
+
+// BreakerStatus is a snapshot of the breaker
+type BreakerStatus struct {
+	State BreakerState
+	// Failures is the number of failed logins in a row
+	Failures int
+	// OpenUntil is set while the breaker is open
+	OpenUntil time.Time
+	LastError string
+}
+
+// breaker stops logins on enlighten after repeated failures, so a wrong
+// password does not lock the account
+type breaker struct {
+	policy BreakerPolicy
+	//now is the clock, tests replace it
+	now func() time.Time
+
+	mu        sync.Mutex
+	state     BreakerState
+	failures  int
+	trips     int
+	openUntil time.Time
+	lastError string
+}
+
+func newBreaker(p BreakerPolicy) *breaker {
+	return &breaker{policy: p, state: BreakerClosed, now: time.Now}
+}
+
+// allow returns ErrCircuitOpen while the breaker is open, and moves it to
+// half-open once the wait is over
+func (b *breaker) allow() error {
+	if b.policy.Failures <= 0 {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state != BreakerOpen {
+		return nil
+	}
+	if b.now().Before(b.openUntil) {
+		return fmt.Errorf("%w, next try at %s", ErrCircuitOpen, b.openUntil.Format(time.RFC3339))
+	}
+
+	b.state = BreakerHalfOpen
+	logging.Infoln("enlighten circuit breaker half-open, trying to login again")
+
+	return nil
+}
+
+// done records the result of a login
+func (b *breaker) done(err error) {
+	if b.policy.Failures <= 0 || errors.Is(err, context.Canceled) {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err == nil {
+		if b.state != BreakerClosed {
+			logging.Infoln("enlighten circuit breaker closed, login succeeded")
+		}
+		b.state = BreakerClosed
+		b.failures = 0
+		b.trips = 0
+		b.lastError = ""
+		return
+	}
+
+	b.failures++
+	b.lastError = err.Error()
+	if b.state != BreakerHalfOpen && b.failures < b.policy.Failures {
+		return
+	}
+
+	d := b.policy.OpenFor
+	for i := 0; i < b.trips && (b.policy.MaxOpenFor <= 0 || d < b.policy.MaxOpenFor); i++ {
+		d *= 2
+	}
+	if b.policy.MaxOpenFor > 0 && d > b.policy.MaxOpenFor {
+		d = b.policy.MaxOpenFor
+	}
+	b.trips++
+
+	b.state = BreakerOpen
+	b.openUntil = b.now().Add(d)
+	logging.Warnf("enlighten circuit breaker open for %v after %d failed logins: %v", d, b.failures, err)
+}
+
+func (b *breaker) status() BreakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s := BreakerStatus{
+		State:     b.state,
+		Failures:  b.failures,
+		LastError: b.lastError,
+	}
+	if b.state == BreakerOpen {
+		s.OpenUntil = b.openUntil
+	}
+	return s
+}
+
+// BreakerStatus returns the state of the enlighten login circuit breaker
+func (e *Envoy) BreakerStatus() BreakerStatus {
+	return e.breaker.status()
+}
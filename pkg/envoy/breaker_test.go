@@ -0,0 +1,147 @@
+package envoy
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+var t0 = time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.t
+}
+
+func TestBreaker(t *testing.T) {
+	results := map[string]error{
+		"ok":       nil,
+		"fail":     errors.New("login failed"),
+		"canceled": context.Canceled,
+	}
+	policy := BreakerPolicy{Failures: 2, OpenFor: time.Minute, MaxOpenFor: 3 * time.Minute}
+
+	type step struct {
+		advance time.Duration
+		//login is the result of the login: "ok", "fail" or "canceled", only
+		//allow is called when it is empty
+		login     string
+		allowErr  bool
+		wantState BreakerState
+		wantOpen  time.Duration
+	}
+
+	tests := []struct {
+		name   string
+		policy BreakerPolicy
+		steps  []step
+	}{
+		{
+			name:   "opens after repeated failures",
+			policy: policy,
+			steps: []step{
+				{login: "fail", wantState: BreakerClosed},
+				{login: "fail", wantState: BreakerOpen, wantOpen: time.Minute},
+				{advance: 59 * time.Second, allowErr: true, wantState: BreakerOpen, wantOpen: time.Second},
+			},
+		},
+		{
+			name:   "success resets the failures",
+			policy: policy,
+			steps: []step{
+				{login: "fail", wantState: BreakerClosed},
+				{login: "ok", wantState: BreakerClosed},
+				{login: "fail", wantState: BreakerClosed},
+			},
+		},
+		{
+			name:   "half-open after the wait",
+			policy: policy,
+			steps: []step{
+				{login: "fail", wantState: BreakerClosed},
+				{login: "fail", wantState: BreakerOpen, wantOpen: time.Minute},
+				{advance: time.Minute, wantState: BreakerHalfOpen},
+			},
+		},
+		{
+			name:   "open time doubles and is capped",
+			policy: policy,
+			steps: []step{
+				{login: "fail", wantState: BreakerClosed},
+				{login: "fail", wantState: BreakerOpen, wantOpen: time.Minute},
+				{advance: time.Minute, login: "fail", wantState: BreakerOpen, wantOpen: 2 * time.Minute},
+				{advance: 2 * time.Minute, login: "fail", wantState: BreakerOpen, wantOpen: 3 * time.Minute},
+				{advance: 3 * time.Minute, login: "fail", wantState: BreakerOpen, wantOpen: 3 * time.Minute},
+			},
+		},
+		{
+			name:   "half-open success closes",
+			policy: policy,
+			steps: []step{
+				{login: "fail", wantState: BreakerClosed},
+				{login: "fail", wantState: BreakerOpen, wantOpen: time.Minute},
+				{advance: time.Minute, login: "fail", wantState: BreakerOpen, wantOpen: 2 * time.Minute},
+				{advance: 2 * time.Minute, login: "ok", wantState: BreakerClosed},
+				//the open time starts over
+				{login: "fail", wantState: BreakerClosed},
+				{login: "fail", wantState: BreakerOpen, wantOpen: time.Minute},
+			},
+		},
+		{
+			name:   "canceled logins are not counted",
+			policy: policy,
+			steps: []step{
+				{login: "canceled", wantState: BreakerClosed},
+				{login: "fail", wantState: BreakerClosed},
+				{login: "canceled", wantState: BreakerClosed},
+			},
+		},
+		{
+			name:   "disabled",
+			policy: BreakerPolicy{},
+			steps: []step{
+				{login: "fail", wantState: BreakerClosed},
+				{login: "fail", wantState: BreakerClosed},
+				{login: "fail", wantState: BreakerClosed},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := &fakeClock{t: t0}
+			b := newBreaker(tt.policy)
+			b.now = clock.now
+
+			for i, s := range tt.steps {
+				clock.t = clock.t.Add(s.advance)
+
+				err := b.allow()
+				if s.allowErr != (err != nil) {
+					t.Fatalf("step %d: allow err = %v, want error %v", i, err, s.allowErr)
+				}
+				if err != nil && !errors.Is(err, ErrCircuitOpen) {
+					t.Fatalf("step %d: allow err = %v, want ErrCircuitOpen", i, err)
+				}
+				if err == nil && s.login != "" {
+					b.done(results[s.login])
+				}
+
+				st := b.status()
+				if st.State != s.wantState {
+					t.Fatalf("step %d: state %s, want %s", i, st.State, s.wantState)
+				}
+				if open := st.OpenUntil.Sub(clock.t); s.wantOpen != 0 && open != s.wantOpen {
+					t.Fatalf("step %d: open for %v, want %v", i, open, s.wantOpen)
+				}
+				if s.wantOpen == 0 && !st.OpenUntil.IsZero() {
+					t.Fatalf("step %d: open until %v, want closed", i, st.OpenUntil)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package envoy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/brutella/dnssd"
+)
+
+const (
+	kEnvoyServiceType = "_enphase-envoy._tcp.local."
+
+	// DefaultDiscoverTimeout is used by Discover when no timeout is given
+	DefaultDiscoverTimeout = 2 * time.Second
+)
+
+// ErrGatewayNotFound is returned when no gateway answered the discovery
+var ErrGatewayNotFound = errors.New("no gateway found")
+
+// DiscoveredGateway is a gateway announced on the local network. Serial,
+// Firmware and ProtocolVersion come from the TXT record, they are empty if
+// the gateway does not announce them.
+type DiscoveredGateway struct {
+	// Host is the address to use to reach the gateway, IPv4 if it has one
+	Host            string   `json:"host"`
+	IPs             []net.IP `json:"ips"`
+	Port            int      `json:"port"`
+	Serial          string   `json:"serial"`
+	Firmware        string   `json:"firmware"`
+	ProtocolVersion string   `json:"protocol_version"`
+}
+
+func newDiscoveredGateway(e *dnssd.BrowseEntry) DiscoveredGateway {
+	g := DiscoveredGateway{
+		Port:            e.Port,
+		Serial:          e.Text["serialnum"],
+		Firmware:        e.Text["fwversion"],
+		ProtocolVersion: e.Text["protovers"],
+	}
+	g.addIPs(e.IPs)
+
+	if g.Host == "" {
+		g.Host = strings.TrimSuffix(e.Host, ".")
+	}
+
+	return g
+}
+
+// merge fills the TXT values missing in g with the ones of o
+func (g *DiscoveredGateway) merge(o DiscoveredGateway) {
+	if g.Serial == "" {
+		g.Serial = o.Serial
+	}
+	if g.Firmware == "" {
+		g.Firmware = o.Firmware
+	}
+	if g.ProtocolVersion == "" {
+		g.ProtocolVersion = o.ProtocolVersion
+	}
+}
+
+// addIPs adds the new addresses and picks the host, IPv4 first
+func (g *DiscoveredGateway) addIPs(ips []net.IP) {
+	for _, ip := range ips {
+		known := false
+		for _, k := range g.IPs {
+			if k.Equal(ip) {
+				known = true
+				break
+			}
+		}
+		if !known {
+			g.IPs = append(g.IPs, ip)
+		}
+	}
+
+	for _, ip := range g.IPs {
+		if ip.To4() != nil {
+			g.Host = ip.String()
+			return
+		}
+	}
+	if len(g.IPs) > 0 && g.Host == "" {
+		g.Host = g.IPs[0].String()
+	}
+}
+
+// Discover browses the local network with mDNS for timeout and returns all
+// gateways found, sorted by serial. A timeout of 0 uses
+// DefaultDiscoverTimeout. ErrGatewayNotFound is returned if there is none.
+func Discover(parent context.Context, timeout time.Duration) ([]DiscoveredGateway, error) {
+	if timeout <= 0 {
+		timeout = DefaultDiscoverTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(parent, timeout)
+	defer cancel()
+
+	//a gateway is announced once per network interface
+	byName := make(map[string]*DiscoveredGateway)
+
+	found := func(e dnssd.BrowseEntry) {
+		logging.Debugf("discovered %s: %v %v", e.Name, e.IPs, e.Text)
+
+		if g, ok := byName[e.Name]; ok {
+			g.addIPs(e.IPs)
+			g.merge(newDiscoveredGateway(&e))
+			return
+		}
+		g := newDiscoveredGateway(&e)
+		byName[e.Name] = &g
+	}
+
+	err := dnssd.LookupType(ctx, kEnvoyServiceType, found, reject)
+	if err != nil && !errors.Is(err, context.DeadlineExceeded) {
+		logging.Debugf("discovery: %v\n", err)
+		return nil, err
+	}
+	if parent.Err() != nil {
+		return nil, parent.Err()
+	}
+
+	gateways := make([]DiscoveredGateway, 0, len(byName))
+	for _, g := range byName {
+		gateways = append(gateways, *g)
+	}
+	if len(gateways) == 0 {
+		return nil, ErrGatewayNotFound
+	}
+
+	sort.Slice(gateways, func(i, j int) bool {
+		if gateways[i].Serial != gateways[j].Serial {
+			return gateways[i].Serial < gateways[j].Serial
+		}
+		return gateways[i].Host < gateways[j].Host
+	})
+
+	return gateways, nil
+}
+
+func reject(e dnssd.BrowseEntry) {
+	logging.Debugf("dnssd-lookup: %+v", e)
+}
@@ -0,0 +1,149 @@
+package envoy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	kEnsembleInventoryUrl = "https://%s/ivp/ensemble/inventory"
+	kEnsemblePowerUrl     = "https://%s/ivp/ensemble/power"
+	kEnsembleSecctrlUrl   = "https://%s/ivp/ensemble/secctrl"
+	kEnsembleRelayUrl     = "https://%s/ivp/ensemble/relay"
+
+	kEnsembleBattery = "ENCHARGE"
+	kEnsembleEnpower = "ENPOWER"
+)
+
+// isNotFound returns true if the gateway does not have the endpoint, like the
+// ensemble ones on sites without batteries
+func isNotFound(err error) bool {
+	var re *ResponseError
+	return errors.As(err, &re) && re.StatusCode == http.StatusNotFound
+}
+
+// EnsembleInventory returns the IQ Batteries and Enpower of the site
+func (e *Envoy) EnsembleInventory(ctx context.Context) (*[]EnsembleInventory, error) {
+	var d []EnsembleInventory
+	if err := e.getJSON(ctx, fmt.Sprintf(kEnsembleInventoryUrl, e.Host()), &d); err != nil {
+		return nil, err
+	}
+
+	return &d, nil
+}
+
+// EnsemblePower returns the power and state of charge of each battery
+func (e *Envoy) EnsemblePower(ctx context.Context) (*EnsemblePower, error) {
+	var d EnsemblePower
+	if err := e.getJSON(ctx, fmt.Sprintf(kEnsemblePowerUrl, e.Host()), &d); err != nil {
+		return nil, err
+	}
+
+	return &d, nil
+}
+
+// EnsembleSecctrl returns the aggregated state of charge and energy of the
+// batteries
+func (e *Envoy) EnsembleSecctrl(ctx context.Context) (*EnsembleSecctrl, error) {
+	var d EnsembleSecctrl
+	if err := e.getJSON(ctx, fmt.Sprintf(kEnsembleSecctrlUrl, e.Host()), &d); err != nil {
+		return nil, err
+	}
+
+	return &d, nil
+}
+
+// EnsembleRelay returns the state of the grid-tie relay, it needs an Enpower
+func (e *Envoy) EnsembleRelay(ctx context.Context) (*EnsembleRelay, error) {
+	var d EnsembleRelay
+	if err := e.getJSON(ctx, fmt.Sprintf(kEnsembleRelayUrl, e.Host()), &d); err != nil {
+		return nil, err
+	}
+
+	return &d, nil
+}
+
+// Battery reads the ensemble endpoints and gathers the state of the batteries
+// and of the Enpower. A site without batteries gives an empty status.
+func (e *Envoy) Battery(ctx context.Context) (*BatteryStatus, error) {
+	b := &BatteryStatus{
+		Batteries: []Battery{},
+		OnGrid:    true,
+	}
+
+	inv, err := e.EnsembleInventory(ctx)
+	if isNotFound(err) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, i := range *inv {
+		for _, d := range i.Devices {
+			switch i.Type {
+			case kEnsembleBattery:
+				b.Batteries = append(b.Batteries, Battery{
+					Serial:        d.SerialNum,
+					PartNum:       d.PartNum,
+					Soc:           d.PercentFull,
+					CapacityWh:    d.EnchargeCapacity,
+					Temperature:   d.Temperature,
+					Status:        strings.Join(d.DeviceStatus, ","),
+					Operating:     d.Operating,
+					Communicating: d.Communicating,
+				})
+			case kEnsembleEnpower:
+				b.Enpower = &Enpower{
+					Serial:          d.SerialNum,
+					Temperature:     d.Temperature,
+					Communicating:   d.Communicating,
+					MainsAdminState: d.MainsAdminState,
+					MainsOperState:  d.MainsOperState,
+					GridMode:        d.EnpwrGridMode,
+				}
+			}
+		}
+	}
+
+	if len(b.Batteries) > 0 {
+		power, err := e.EnsemblePower(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range power.Devices {
+			for i := range b.Batteries {
+				if b.Batteries[i].Serial != p.SerialNum {
+					continue
+				}
+				b.Batteries[i].PowerW = p.RealPowerMw / 1000
+				b.Batteries[i].Soc = p.Soc
+				b.PowerW += b.Batteries[i].PowerW
+			}
+		}
+
+		sec, err := e.EnsembleSecctrl(ctx)
+		if err != nil {
+			return nil, err
+		}
+		b.Soc = sec.AggSoc
+		b.AvailableEnergyWh = sec.EncAggAvailEnergy
+		b.MaxEnergyWh = sec.MaxEnergy
+	}
+
+	if b.Enpower != nil {
+		relay, err := e.EnsembleRelay(ctx)
+		if err != nil {
+			return nil, err
+		}
+		b.OnGrid = relay.OnGrid()
+		b.GridMode = relay.EnchgGridMode
+		b.Enpower.MainsAdminState = relay.MainsAdminState
+		b.Enpower.MainsOperState = relay.MainsOperState
+	}
+
+	return b, nil
+}
@@ -0,0 +1,590 @@
+// Package envoy is a client for the Enphase IQ Gateway (Envoy).
+//
+// Since firmware 7, the gateway only answers with a jwt token delivered by the
+// Enlighten cloud. The client gets this token, keeps it up to date and uses it
+// to open a session on the local gateway.
+package envoy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/publicsuffix"
+
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var logging *logrus.Entry
+
+func init() {
+	logging = logrus.StandardLogger().WithField("domain", "envoy")
+}
+
+// SetLogger replaces the logger used by the package
+func SetLogger(l *logrus.Entry) {
+	logging = l
+}
+
+func SetLoggerLevel(l logrus.Level) {
+	logging.Logger.SetLevel(l)
+}
+
+// Envoy is a client for one gateway
+type Envoy struct {
+	//counters first, they are updated with sync/atomic and must be 64-bit aligned
+	stats Stats
+
+	creds            Credentials
+	managerSessionId string
+	localSessionId   string
+
+	client *http.Client
+	store  CredentialStore
+
+	//mu protects the credentials, authMu serializes logins and protects
+	//tokenRefreshedAt
+	mu               sync.RWMutex
+	authMu           sync.Mutex
+	tokenRefreshedAt time.Time
+
+	cancelRefresh context.CancelFunc
+	wgRefresh     sync.WaitGroup
+
+	lastRediscover time.Time
+	lastLiveEnable time.Time
+
+	//pinUnsaved is set when a certificate was pinned but not saved yet
+	pinUnsaved bool
+
+	retryPolicy   RetryPolicy
+	breakerPolicy BreakerPolicy
+	breaker       *breaker
+
+	//after waits between retries, tests replace it
+	after func(time.Duration) <-chan time.Time
+}
+
+const (
+	kEnlightenLoginUrl  = "https://enlighten.enphaseenergy.com/login/login.json"
+	kEnlightenTokenUrl  = "https://enlighten.enphaseenergy.com/entrez-auth-token?serial_num=%s"
+	kEnvoyCheckTokenUrl = "https://%s/auth/check_jwt"
+	kEnvoyProductionUrl = "https://%s/production.json?details=1"
+)
+
+// New creates a client. The credentials are loaded from the store given with
+// WithStore, values given with the other options take precedence over it.
+func New(opts ...Option) (*Envoy, error) {
+	e := &Envoy{
+		retryPolicy:   DefaultRetryPolicy,
+		breakerPolicy: DefaultBreakerPolicy,
+		after:         time.After,
+	}
+	for _, o := range opts {
+		o(e)
+	}
+	e.breaker = newBreaker(e.breakerPolicy)
+
+	if e.store != nil {
+		c, err := e.store.Load()
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		if c != nil {
+			e.creds = mergeCredentials(*c, e.creds)
+		}
+	}
+
+	//Older caches do not have the expiry, get it back from the token itself
+	if e.creds.JWTToken != "" && e.creds.JWTExpiry == 0 {
+		if c, err := parseJWTClaims(e.creds.JWTToken); err == nil {
+			e.creds.JWTExpiry = c.Exp
+		}
+	}
+
+	if e.client == nil {
+		e.client = e.newClient()
+	}
+
+	return e, nil
+}
+
+// Credentials returns a copy of the current credentials and token
+func (e *Envoy) Credentials() Credentials {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.creds
+}
+
+// Host returns the address of the gateway
+func (e *Envoy) Host() string {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.creds.Host
+}
+
+// Serial returns the serial number of the gateway
+func (e *Envoy) Serial() string {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.creds.Serial
+}
+
+// Close writes the credentials and token to the store
+func (e *Envoy) Close() {
+	e.save()
+}
+
+func (e *Envoy) save() {
+	if e.store == nil {
+		return
+	}
+
+	c := e.Credentials()
+	if err := e.store.Save(&c); err != nil {
+		logging.Errorf("failed to save credentials: %v", err)
+	}
+}
+
+func (e *Envoy) Login(ctx context.Context) (err error) {
+	logging.Debug("Login")
+
+	u := kEnlightenLoginUrl
+
+	v := url.Values{}
+	c := e.Credentials()
+	v.Add("user[email]", c.Username)
+	v.Add("user[password]", c.Password)
+	encodedData := v.Encode()
+
+	//encodedData := fmt.Sprintf("user[email]=%s&user[password]=%s", e.Username, e.Password)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", u, strings.NewReader(encodedData))
+	if err != nil {
+		return
+	}
+
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Add("Content-Length", strconv.Itoa(len(encodedData)))
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return cloudError(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return cloudError(err)
+	}
+
+	if resp.StatusCode >= 500 {
+		return cloudError(newResponseError(resp.StatusCode, body, nil))
+	}
+
+	var d loginManagerToken
+	err = json.Unmarshal(body, &d)
+	if err != nil {
+		logging.Debugf("login failure:\n%s", body)
+		if resp.StatusCode == http.StatusUnauthorized {
+			return ErrBadCredentials
+		}
+		return newResponseError(resp.StatusCode, body, err)
+	}
+
+	if d.Message != "success" {
+		return fmt.Errorf("%w: %s", ErrBadCredentials, d.Message)
+	}
+
+	e.mu.Lock()
+	e.managerSessionId = d.SessionId
+	e.mu.Unlock()
+
+	return
+}
+
+func (e *Envoy) GetToken(ctx context.Context) (err error) {
+	logging.Debugf("GetToken")
+
+	u := fmt.Sprintf(kEnlightenTokenUrl, e.Serial())
+	uri, err := url.Parse(u)
+	if err != nil {
+		return
+	}
+
+	e.mu.RLock()
+	e.client.Jar.SetCookies(uri, []*http.Cookie{
+		{
+			Name:  "_enlighten_4_session",
+			Value: e.managerSessionId,
+		},
+	})
+	e.mu.RUnlock()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return cloudError(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return cloudError(err)
+	}
+
+	switch {
+	case resp.StatusCode >= 500:
+		return cloudError(newResponseError(resp.StatusCode, body, nil))
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return ErrBadCredentials
+	case resp.StatusCode != http.StatusOK:
+		return newResponseError(resp.StatusCode, body, nil)
+	}
+
+	var d loginToken
+	err = json.Unmarshal(body, &d)
+	if err != nil {
+		return newResponseError(resp.StatusCode, body, err)
+	}
+
+	if d.Token == "" {
+		return fmt.Errorf("%w: no token for gateway %s", ErrBadCredentials, e.Serial())
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.creds.JWTToken = d.Token
+	e.creds.TokenGeneratedAt = d.GenerationTime
+	e.creds.TokenExpiry = d.ExpiresAt
+	e.creds.JWTExpiry = 0
+
+	c, err := parseJWTClaims(d.Token)
+	if err != nil {
+		logging.Debugf("failed to decode jwt token: %v", err)
+		return nil
+	}
+	e.creds.JWTExpiry = c.Exp
+
+	return
+}
+
+func (e *Envoy) GetLocalSessionCookie(ctx context.Context) (err error) {
+	logging.Debugf("GetLocalSessionCookie")
+
+	u := fmt.Sprintf(kEnvoyCheckTokenUrl, e.Host())
+	uri, err := url.Parse(u)
+	if err != nil {
+		return
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return
+	}
+
+	req.Header.Set("Authorization", "Bearer "+e.token())
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return gatewayError(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return gatewayError(err)
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return ErrUnauthorized
+	case resp.StatusCode != http.StatusOK:
+		return newResponseError(resp.StatusCode, body, nil)
+	case !strings.Contains(string(body), "Valid token"):
+		return ErrUnauthorized
+	}
+
+	for _, c := range e.client.Jar.Cookies(uri) {
+		if c.Name == "sessionId" {
+			e.mu.Lock()
+			e.localSessionId = c.Value
+			e.mu.Unlock()
+		}
+	}
+	e.savePin()
+
+	return
+}
+
+// open does a GET on the gateway using the local session cookie.
+// ErrUnauthorized is returned if the gateway does not accept the session, a
+// ResponseError for any other status than 200.
+func (e *Envoy) open(ctx context.Context, u string) (*http.Response, error) {
+	return e.request(ctx, "GET", u, nil)
+}
+
+// request sends a request to the gateway using the local session cookie, see
+// open
+func (e *Envoy) request(ctx context.Context, method, u string, body []byte) (*http.Response, error) {
+	uri, err := url.Parse(u)
+	if err != nil {
+		return nil, err
+	}
+
+	e.mu.RLock()
+	e.client.Jar.SetCookies(uri, []*http.Cookie{
+		{
+			Name:  "sessionId",
+			Value: e.localSessionId,
+		},
+	})
+	e.mu.RUnlock()
+
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, r)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return nil, gatewayError(err)
+	}
+
+	//The gateway either replies 401 or redirects to its login page
+	if resp.StatusCode == http.StatusUnauthorized ||
+		resp.StatusCode == http.StatusForbidden ||
+		(resp.StatusCode >= 300 && resp.StatusCode < 400) {
+		resp.Body.Close()
+		return nil, ErrUnauthorized
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, kErrorBodySnippet))
+		return nil, newResponseError(resp.StatusCode, body, nil)
+	}
+	e.savePin()
+
+	return resp, nil
+}
+
+// get fetches an url from the gateway using the local session cookie. The
+// request is retried following the retry policy.
+func (e *Envoy) get(ctx context.Context, u string) (b []byte, err error) {
+	err = e.retry(ctx, func() error {
+		resp, err := e.open(ctx, u)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		b, err = io.ReadAll(resp.Body)
+		return gatewayError(err)
+	})
+	return
+}
+
+// getJSON fetches an url from the gateway and decodes its json. A body that
+// is not json, like a login page, gives a ResponseError.
+func (e *Envoy) getJSON(ctx context.Context, u string, v interface{}) error {
+	body, err := e.get(ctx, u)
+	if err != nil {
+		return err
+	}
+
+	if err = json.Unmarshal(body, v); err != nil {
+		return newResponseError(http.StatusOK, body, err)
+	}
+	return nil
+}
+
+// putJSON sends v as json to an url of the gateway. It is not retried.
+func (e *Envoy) putJSON(ctx context.Context, u string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	resp, err := e.request(ctx, "PUT", u, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	_, err = io.Copy(io.Discard, resp.Body)
+	return gatewayError(err)
+}
+
+func (e *Envoy) Production(ctx context.Context) (*Production, error) {
+	var d Production
+	if err := e.getJSON(ctx, fmt.Sprintf(kEnvoyProductionUrl, e.Host()), &d); err != nil {
+		return nil, err
+	}
+
+	return &d, nil
+}
+
+func (e *Envoy) Home(ctx context.Context) (*Home, error) {
+	var d Home
+	if err := e.getJSON(ctx, fmt.Sprintf("https://%s/home.json", e.Host()), &d); err != nil {
+		return nil, err
+	}
+
+	return &d, nil
+}
+
+// http://envoy.local/inventory.json?deleted=1
+func (e *Envoy) Inventory(ctx context.Context) (*[]Inventory, error) {
+	var d []Inventory
+	if err := e.getJSON(ctx, fmt.Sprintf("https://%s/inventory.json", e.Host()), &d); err != nil {
+		return nil, err
+	}
+
+	return &d, nil
+}
+
+func (e *Envoy) Info(ctx context.Context) (*EnvoyInfo, error) {
+	body, err := e.get(ctx, fmt.Sprintf("https://%s/info.xml", e.Host()))
+	if err != nil {
+		return nil, err
+	}
+
+	var i EnvoyInfo
+	err = xml.Unmarshal(body, &i)
+	if err != nil {
+		return nil, newResponseError(http.StatusOK, body, err)
+	}
+
+	return &i, nil
+}
+
+func (e *Envoy) Now(ctx context.Context) (float64, float64, float64, error) {
+	s, err := e.Production(ctx)
+	if err != nil {
+		return 0.0, 0.0, 0.0, err
+	}
+	tp := 0.0
+	for _, v := range s.Production {
+		if v.MeasurementType == "production" {
+			tp = v.WNow
+		}
+	}
+	tc := 0.0
+	for _, v := range s.Consumption {
+		if v.MeasurementType == "total-consumption" {
+			tc = v.WNow
+		}
+	}
+	net := 0.0
+	for _, v := range s.Consumption {
+		if v.MeasurementType == "net-consumption" {
+			net = v.WNow
+		}
+	}
+	return tp, tc, net, nil
+}
+
+func (e *Envoy) Today(ctx context.Context) (float64, float64, float64, error) {
+	s, err := e.Production(ctx)
+	if err != nil {
+		return 0.0, 0.0, 0.0, err
+	}
+	tp := 0.0
+	for _, v := range s.Production {
+		if v.MeasurementType == "production" {
+			tp = v.WhToday
+		}
+	}
+	tc := 0.0
+	for _, v := range s.Consumption {
+		if v.MeasurementType == "total-consumption" {
+			tc = v.WhToday
+		}
+	}
+	tnp := 0.0
+	for _, v := range s.Consumption {
+		if v.MeasurementType == "net-consumption" {
+			tnp = v.WhToday
+		}
+	}
+	return tp, tc, tnp, nil
+}
+
+func (e *Envoy) Inverters(ctx context.Context) (*[]Inverter, error) {
+	var i []Inverter
+	if err := e.getJSON(ctx, fmt.Sprintf("https://%s/api/v1/production/inverters", e.Host()), &i); err != nil {
+		return nil, err
+	}
+	return &i, nil
+}
+
+func (e *Envoy) SystemMax(ctx context.Context) (uint64, error) {
+	inverters, err := e.Inverters(ctx)
+	if err != nil {
+		return 0, err
+	}
+	var max uint64
+	for _, v := range *inverters {
+		max += uint64(v.MaxReportWatts)
+	}
+	return max, nil
+}
+
+// newClient creates the default http client. The gateway certificate is
+// pinned on first use, see dialTLS.
+func (e *Envoy) newClient() *http.Client {
+	tr := &http.Transport{
+		ResponseHeaderTimeout: 3 * time.Second,
+		DisableKeepAlives:     true,
+		MaxIdleConns:          5,
+		IdleConnTimeout:       20 * time.Second,
+		DisableCompression:    true,
+		DialTLSContext:        e.dialTLS,
+	}
+
+	jar, err := cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List})
+	if err != nil {
+		logging.Debug(err)
+	}
+
+	client := &http.Client{
+		Transport: tr,
+		Jar:       jar,
+		//Only follow http -> https redirects, a redirect to another page
+		//means the gateway wants us to login again
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			if req.URL.Host != via[0].URL.Host || req.URL.Path != via[0].URL.Path {
+				return http.ErrUseLastResponse
+			}
+			return nil
+		},
+	}
+	return client
+}
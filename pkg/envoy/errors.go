@@ -0,0 +1,110 @@
+package envoy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// size of the body kept in ResponseError
+const kErrorBodySnippet = 256
+
+var (
+	// ErrUnauthorized is returned when the gateway rejects the session or the token
+	ErrUnauthorized = errors.New("auth required")
+
+	// ErrBadCredentials is returned when enlighten rejects the account, or
+	// does not give a token for the gateway serial. Retrying will not help.
+	ErrBadCredentials = errors.New("enlighten rejected the credentials")
+
+	// ErrGatewayUnreachable is returned when the gateway can not be reached
+	// at all, it may have a new address
+	ErrGatewayUnreachable = errors.New("gateway unreachable")
+
+	// ErrCloudUnavailable is returned when enlighten can not be reached or
+	// fails on its side
+	ErrCloudUnavailable = errors.New("enlighten unavailable")
+
+	// ErrNotSupported is returned when the gateway does not have an
+	// endpoint, on older firmware or sites without the hardware
+	ErrNotSupported = errors.New("not supported by the gateway")
+
+	// ErrUnexpectedResponse is matched by ResponseError
+	ErrUnexpectedResponse = errors.New("unexpected response")
+)
+
+// ResponseError is returned when a server replies with an unexpected status
+// or a body that can not be decoded. It matches ErrUnexpectedResponse.
+type ResponseError struct {
+	StatusCode int
+	// Body is the beginning of the response
+	Body string
+	// Err is the decoding error, if any
+	Err error
+}
+
+func newResponseError(status int, body []byte, err error) *ResponseError {
+	if len(body) > kErrorBodySnippet {
+		body = body[:kErrorBodySnippet]
+	}
+	return &ResponseError{
+		StatusCode: status,
+		Body:       strings.TrimSpace(string(body)),
+		Err:        err,
+	}
+}
+
+func (e *ResponseError) Error() string {
+	s := fmt.Sprintf("%v: status %d", ErrUnexpectedResponse, e.StatusCode)
+	if e.Err != nil {
+		s += ": " + e.Err.Error()
+	}
+	if e.Body != "" {
+		s += fmt.Sprintf(": %q", e.Body)
+	}
+	return s
+}
+
+func (e *ResponseError) Is(target error) bool {
+	return target == ErrUnexpectedResponse
+}
+
+func (e *ResponseError) Unwrap() error {
+	return e.Err
+}
+
+// kindError is an error that also matches kind with errors.Is
+type kindError struct {
+	kind error
+	err  error
+}
+
+func (e *kindError) Error() string {
+	return e.kind.Error() + ": " + e.err.Error()
+}
+
+func (e *kindError) Is(target error) bool {
+	return target == e.kind
+}
+
+func (e *kindError) Unwrap() error {
+	return e.err
+}
+
+// gatewayError marks errors of a request to the gateway that did not get an
+// answer with ErrGatewayUnreachable
+func gatewayError(err error) error {
+	if err == nil || !isConnectionError(err) {
+		return err
+	}
+	return &kindError{kind: ErrGatewayUnreachable, err: err}
+}
+
+// cloudError marks errors of a request to enlighten with ErrCloudUnavailable
+func cloudError(err error) error {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return err
+	}
+	return &kindError{kind: ErrCloudUnavailable, err: err}
+}
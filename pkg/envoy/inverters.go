@@ -0,0 +1,73 @@
+package envoy
+
+import (
+	"sort"
+)
+
+// InverterStatus is an inverter joined with its device in the inventory
+type InverterStatus struct {
+	Inverter
+	PartNum       string   `json:"partNum"`
+	Producing     bool     `json:"producing"`
+	Communicating bool     `json:"communicating"`
+	DeviceStatus  []string `json:"deviceStatus"`
+	// Performance is the last report relative to the median of all the
+	// inverters, 1 is the median. It is 0 if the median is 0, at night.
+	Performance float64 `json:"performance"`
+}
+
+// Median returns the median of values, 0 if there are none
+func Median(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+
+	v := make([]float64, len(values))
+	copy(v, values)
+	sort.Float64s(v)
+
+	n := len(v)
+	if n%2 == 1 {
+		return v[n/2]
+	}
+	return (v[n/2-1] + v[n/2]) / 2
+}
+
+// JoinInverters joins the inverters with the inventory devices by serial
+// number and computes their performance. The result is sorted by serial.
+func JoinInverters(inverters []Inverter, inventory []Inventory) []InverterStatus {
+	devices := make(map[string]*Device)
+	for i := range inventory {
+		for j := range inventory[i].Devices {
+			d := &inventory[i].Devices[j]
+			devices[d.SerialNum] = d
+		}
+	}
+
+	watts := make([]float64, 0, len(inverters))
+	for _, i := range inverters {
+		watts = append(watts, float64(i.LastReportWatts))
+	}
+	median := Median(watts)
+
+	res := make([]InverterStatus, 0, len(inverters))
+	for _, i := range inverters {
+		s := InverterStatus{Inverter: i}
+		if d, ok := devices[i.SerialNumber]; ok {
+			s.PartNum = d.PartNum
+			s.Producing = d.Producing
+			s.Communicating = d.Communicating
+			s.DeviceStatus = d.DeviceStatus
+		}
+		if median > 0 {
+			s.Performance = float64(i.LastReportWatts) / median
+		}
+		res = append(res, s)
+	}
+
+	sort.Slice(res, func(a, b int) bool {
+		return res[a].SerialNumber < res[b].SerialNumber
+	})
+
+	return res
+}
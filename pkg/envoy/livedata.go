@@ -0,0 +1,74 @@
+package envoy
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const (
+	kLiveDataStatusUrl = "https://%s/ivp/livedata/status"
+	kLiveDataStreamUrl = "https://%s/ivp/livedata/stream"
+
+	//the gateway stops the live stream after a few minutes, enable it again
+	//well before
+	kLiveStreamKeepAlive = time.Minute
+)
+
+// LiveDataStatus reads the live data as is. ErrNotSupported is returned by
+// firmware without live data.
+func (e *Envoy) LiveDataStatus(ctx context.Context) (*LiveData, error) {
+	var d LiveData
+	err := e.getJSON(ctx, fmt.Sprintf(kLiveDataStatusUrl, e.Host()), &d)
+	if isNotFound(err) {
+		return nil, fmt.Errorf("%w: %v", ErrNotSupported, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &d, nil
+}
+
+// EnableLiveStream asks the gateway to update the live data for the next
+// minutes
+func (e *Envoy) EnableLiveStream(ctx context.Context) error {
+	err := e.putJSON(ctx, fmt.Sprintf(kLiveDataStreamUrl, e.Host()), map[string]int{"enable": 1})
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	e.lastLiveEnable = time.Now()
+	e.mu.Unlock()
+
+	return nil
+}
+
+// LiveData reads the live data and keeps the live stream enabled, so it can be
+// called in a loop
+func (e *Envoy) LiveData(ctx context.Context) (*LiveData, error) {
+	d, err := e.LiveDataStatus(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	e.mu.RLock()
+	due := time.Since(e.lastLiveEnable) > kLiveStreamKeepAlive
+	e.mu.RUnlock()
+
+	if d.Streaming() && !due {
+		return d, nil
+	}
+
+	logging.Debugln("enabling live data stream")
+	if err = e.EnableLiveStream(ctx); err != nil {
+		return nil, err
+	}
+	if d.Streaming() {
+		return d, nil
+	}
+
+	//the meters were not updated before
+	return e.LiveDataStatus(ctx)
+}
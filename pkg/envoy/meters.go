@@ -0,0 +1,32 @@
+package envoy
+
+import (
+	"context"
+	"fmt"
+)
+
+const (
+	kMetersUrl        = "https://%s/ivp/meters"
+	kMeterReadingsUrl = "https://%s/ivp/meters/readings"
+)
+
+// Meters returns the configuration of the CT meters
+func (e *Envoy) Meters(ctx context.Context) (*[]Meter, error) {
+	var d []Meter
+	if err := e.getJSON(ctx, fmt.Sprintf(kMetersUrl, e.Host()), &d); err != nil {
+		return nil, err
+	}
+
+	return &d, nil
+}
+
+// MeterReadings returns the values of the CT meters, they are matched with
+// Meters by EID
+func (e *Envoy) MeterReadings(ctx context.Context) (*[]MeterReading, error) {
+	var d []MeterReading
+	if err := e.getJSON(ctx, fmt.Sprintf(kMeterReadingsUrl, e.Host()), &d); err != nil {
+		return nil, err
+	}
+
+	return &d, nil
+}
@@ -0,0 +1,81 @@
+package envoy
+
+import (
+	"net/http"
+	"net/http/cookiejar"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// Option configures an Envoy created with New
+type Option func(*Envoy)
+
+// WithHost sets the address of the gateway
+func WithHost(host string) Option {
+	return func(e *Envoy) {
+		e.creds.Host = host
+	}
+}
+
+// WithCredentials sets the Enlighten account used to get a token
+func WithCredentials(username, password string) Option {
+	return func(e *Envoy) {
+		e.creds.Username = username
+		e.creds.Password = password
+	}
+}
+
+// WithSerial sets the serial number of the gateway
+func WithSerial(serial string) Option {
+	return func(e *Envoy) {
+		e.creds.Serial = serial
+	}
+}
+
+// WithToken sets an already known jwt token
+func WithToken(token string) Option {
+	return func(e *Envoy) {
+		e.creds.JWTToken = token
+	}
+}
+
+// WithHTTPClient sets the http client used for all requests. The client is
+// copied, a cookie jar is added to the copy if it has none, it is needed for
+// the gateway session: the session cookies are not shared with other users of
+// the client. The client is used as is otherwise: the gateway certificate is
+// only pinned and checked by the default client, a custom transport must
+// verify it itself.
+func WithHTTPClient(c *http.Client) Option {
+	return func(e *Envoy) {
+		cc := *c
+		if cc.Jar == nil {
+			jar, err := cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List})
+			if err != nil {
+				logging.Debug(err)
+			}
+			cc.Jar = jar
+		}
+		e.client = &cc
+	}
+}
+
+// WithStore sets where credentials and token are loaded from and saved to
+func WithStore(s CredentialStore) Option {
+	return func(e *Envoy) {
+		e.store = s
+	}
+}
+
+// WithRetryPolicy sets how idempotent requests are retried
+func WithRetryPolicy(p RetryPolicy) Option {
+	return func(e *Envoy) {
+		e.retryPolicy = p
+	}
+}
+
+// WithBreakerPolicy sets when logins on enlighten are suspended after failures
+func WithBreakerPolicy(p BreakerPolicy) Option {
+	return func(e *Envoy) {
+		e.breakerPolicy = p
+	}
+}
@@ -0,0 +1,139 @@
+package envoy
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	//discovery is not run again before that, the gateway may just be down
+	kRediscoverMinInterval = time.Minute
+	kRediscoverInfoTimeout = 5 * time.Second
+)
+
+// isConnectionError returns true if the gateway could not be reached at all,
+// as opposed to an error returned by the gateway
+func isConnectionError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return true
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// infoAt reads info.xml of the gateway at host, it does not need a session
+func (e *Envoy) infoAt(ctx context.Context, host string) (*EnvoyInfo, error) {
+	ctx, cancel := context.WithTimeout(ctx, kRediscoverInfoTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("https://%s/info.xml", host), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return nil, gatewayError(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, gatewayError(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, newResponseError(resp.StatusCode, body, nil)
+	}
+
+	var i EnvoyInfo
+	if err = xml.Unmarshal(body, &i); err != nil {
+		return nil, newResponseError(resp.StatusCode, body, err)
+	}
+	return &i, nil
+}
+
+// Rediscover looks for the gateway on the local network and updates its
+// address. The serial must be known, the serial announced by each gateway
+// found is checked against its info.xml. The new address is saved in the
+// store.
+func (e *Envoy) Rediscover(ctx context.Context) error {
+	serial := e.Serial()
+	if serial == "" {
+		return errors.New("gateway serial is required to rediscover it")
+	}
+
+	gateways, err := Discover(ctx, 0)
+	if err != nil {
+		return err
+	}
+
+	for _, g := range gateways {
+		if g.Serial != "" && g.Serial != serial {
+			continue
+		}
+
+		info, err := e.infoAt(ctx, g.Host)
+		if err != nil {
+			logging.Debugf("failed to read info of %s: %v", g.Host, err)
+			continue
+		}
+		if info.Device.Sn != serial {
+			continue
+		}
+
+		e.mu.Lock()
+		old := e.creds.Host
+		e.creds.Host = g.Host
+		e.mu.Unlock()
+
+		if old != g.Host {
+			logging.Infof("gateway %s moved from %s to %s", serial, old, g.Host)
+			e.save()
+		}
+		return nil
+	}
+
+	return ErrGatewayNotFound
+}
+
+// rediscoverAfter runs Rediscover if err means the gateway could not be
+// reached, at most once per kRediscoverMinInterval. It returns true if the
+// gateway was found at a new address.
+func (e *Envoy) rediscoverAfter(ctx context.Context, err error) bool {
+	if !errors.Is(err, ErrGatewayUnreachable) || ctx.Err() != nil {
+		return false
+	}
+
+	e.mu.Lock()
+	if time.Since(e.lastRediscover) < kRediscoverMinInterval {
+		e.mu.Unlock()
+		return false
+	}
+	e.lastRediscover = time.Now()
+	old := e.creds.Host
+	e.mu.Unlock()
+
+	logging.Debugf("gateway %s unreachable, looking for it on the network: %v", old, err)
+
+	if err := e.Rediscover(ctx); err != nil {
+		logging.Warnf("failed to rediscover gateway: %v", err)
+		return false
+	}
+
+	return e.Host() != old
+}
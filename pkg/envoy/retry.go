@@ -0,0 +1,76 @@
+package envoy
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// RetryPolicy sets how idempotent requests are retried when the gateway or
+// enlighten drop them
+type RetryPolicy struct {
+	// Attempts is the total number of tries, 1 disables retries
+	Attempts int
+	// MinDelay is the wait before the first retry, it doubles after each try
+	MinDelay time.Duration
+	// MaxDelay caps the wait between tries
+	MaxDelay time.Duration
+	// Jitter randomizes each wait by up to this fraction of it
+	Jitter float64
+}
+
+// DefaultRetryPolicy is used when WithRetryPolicy is not given
+var DefaultRetryPolicy = RetryPolicy{
+	Attempts: 3,
+	MinDelay: 200 * time.Millisecond,
+	MaxDelay: 2 * time.Second,
+	Jitter:   0.2,
+}
+
+// delay returns the wait before the retry following try n (starting at 1)
+func (p *RetryPolicy) delay(n int) time.Duration {
+	d := p.MinDelay
+	for i := 1; i < n && d < p.MaxDelay; i++ {
+		d *= 2
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	if p.Jitter > 0 {
+		d += time.Duration((rand.Float64()*2 - 1) * p.Jitter * float64(d))
+	}
+	return d
+}
+
+// retryable returns true for errors that may go away with a new try: no
+// answer, or a server error
+func retryable(err error) bool {
+	if errors.Is(err, ErrGatewayUnreachable) || errors.Is(err, ErrCloudUnavailable) {
+		return true
+	}
+	var re *ResponseError
+	return errors.As(err, &re) && re.StatusCode >= http.StatusInternalServerError
+}
+
+// retry runs req until it succeeds, fails with an error that is not
+// retryable, or the policy attempts are exhausted. It must only be used for
+// idempotent requests.
+func (e *Envoy) retry(ctx context.Context, req func() error) (err error) {
+	for n := 1; ; n++ {
+		err = req()
+		if err == nil || n >= e.retryPolicy.Attempts || !retryable(err) {
+			return
+		}
+
+		d := e.retryPolicy.delay(n)
+		logging.Debugf("request failed, retrying in %v (%d/%d): %v", d, n, e.retryPolicy.Attempts, err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-e.after(d):
+		}
+	}
+}
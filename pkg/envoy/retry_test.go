@@ -0,0 +1,142 @@
+package envoy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRetry(t *testing.T) {
+	errOther := errors.New("other")
+	unavailable := newResponseError(http.StatusServiceUnavailable, nil, nil)
+	policy := RetryPolicy{Attempts: 4, MinDelay: time.Second, MaxDelay: 3 * time.Second}
+
+	tests := []struct {
+		name       string
+		policy     RetryPolicy
+		errs       []error
+		wantCalls  int
+		wantErr    error
+		wantDelays []time.Duration
+	}{
+		{
+			name:      "success",
+			policy:    policy,
+			errs:      []error{nil},
+			wantCalls: 1,
+		},
+		{
+			name:       "success after retries",
+			policy:     policy,
+			errs:       []error{ErrGatewayUnreachable, unavailable, nil},
+			wantCalls:  3,
+			wantDelays: []time.Duration{time.Second, 2 * time.Second},
+		},
+		{
+			name:       "attempts exhausted",
+			policy:     policy,
+			errs:       []error{ErrCloudUnavailable, ErrCloudUnavailable, ErrCloudUnavailable, ErrCloudUnavailable, nil},
+			wantCalls:  4,
+			wantErr:    ErrCloudUnavailable,
+			wantDelays: []time.Duration{time.Second, 2 * time.Second, 3 * time.Second},
+		},
+		{
+			name:       "not retryable",
+			policy:     policy,
+			errs:       []error{ErrGatewayUnreachable, errOther, nil},
+			wantCalls:  2,
+			wantErr:    errOther,
+			wantDelays: []time.Duration{time.Second},
+		},
+		{
+			name:      "client error",
+			policy:    policy,
+			errs:      []error{newResponseError(http.StatusNotFound, nil, nil), nil},
+			wantCalls: 1,
+			wantErr:   ErrUnexpectedResponse,
+		},
+		{
+			name:      "retries disabled",
+			policy:    RetryPolicy{Attempts: 1},
+			errs:      []error{ErrGatewayUnreachable, nil},
+			wantCalls: 1,
+			wantErr:   ErrGatewayUnreachable,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var delays []time.Duration
+			e := &Envoy{
+				retryPolicy: tt.policy,
+				after: func(d time.Duration) <-chan time.Time {
+					delays = append(delays, d)
+					c := make(chan time.Time, 1)
+					c <- t0
+					return c
+				},
+			}
+
+			calls := 0
+			err := e.retry(context.Background(), func() error {
+				calls++
+				return tt.errs[calls-1]
+			})
+
+			if !errors.Is(err, tt.wantErr) || (err == nil) != (tt.wantErr == nil) {
+				t.Errorf("err = %v, want %v", err, tt.wantErr)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("%d calls, want %d", calls, tt.wantCalls)
+			}
+			if !reflect.DeepEqual(delays, tt.wantDelays) {
+				t.Errorf("delays %v, want %v", delays, tt.wantDelays)
+			}
+		})
+	}
+}
+
+func TestRetryCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	e := &Envoy{
+		retryPolicy: DefaultRetryPolicy,
+		after: func(d time.Duration) <-chan time.Time {
+			cancel()
+			return nil
+		},
+	}
+
+	calls := 0
+	err := e.retry(ctx, func() error {
+		calls++
+		return ErrGatewayUnreachable
+	})
+	if calls != 1 || !errors.Is(err, ErrGatewayUnreachable) {
+		t.Errorf("%d calls, err = %v, want 1 call and the last error", calls, err)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	p := RetryPolicy{MinDelay: 100 * time.Millisecond, MaxDelay: time.Second, Jitter: 0.2}
+	want := []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+		800 * time.Millisecond,
+		time.Second,
+		time.Second,
+	}
+
+	for i, w := range want {
+		lo := time.Duration(float64(w) * (1 - p.Jitter))
+		hi := time.Duration(float64(w) * (1 + p.Jitter))
+		for j := 0; j < 100; j++ {
+			if d := p.delay(i + 1); d < lo || d > hi {
+				t.Fatalf("delay after try %d is %v, want between %v and %v", i+1, d, lo, hi)
+			}
+		}
+	}
+}
@@ -0,0 +1,289 @@
+package envoy
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// Session keeps an authenticated connection to the gateway for long running
+// programs. The local sessionId cookie is reused until the gateway rejects it,
+// only then it is renewed with the jwt token. The token itself is renewed on
+// enlighten when it is close to its expiry, see EnsureToken, or when the
+// gateway does not accept it anymore.
+type Session struct {
+	e *Envoy
+
+	//mu serializes the authentications, requests run concurrently. gen is
+	//incremented on each new session.
+	mu            sync.Mutex
+	authenticated bool
+	gen           uint64
+}
+
+// NewSession creates a session on top of an Envoy
+func NewSession(e *Envoy) *Session {
+	return &Session{e: e}
+}
+
+// Envoy returns the underlying Envoy
+func (s *Session) Envoy() *Envoy {
+	return s.e
+}
+
+// Authenticate gets a new local session cookie from the gateway, login again
+// on enlighten if needed.
+func (s *Session) Authenticate(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.authenticate(ctx)
+}
+
+// Authenticated returns true if the session has a valid cookie
+func (s *Session) Authenticated() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.authenticated
+}
+
+// Invalidate forces a new authentication on next request
+func (s *Session) Invalidate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.authenticated = false
+}
+
+func (s *Session) authenticate(ctx context.Context) (err error) {
+	s.authenticated = false
+
+	//No token yet or token about to expire, try to login
+	err = s.e.EnsureToken(ctx)
+	if err != nil {
+		return
+	}
+
+	//Try to get the local cookie, the gateway may have a new address
+	err = s.e.GetLocalSessionCookie(ctx)
+	if err != nil && s.e.rediscoverAfter(ctx, err) {
+		err = s.e.GetLocalSessionCookie(ctx)
+	}
+	if err != nil && !errors.Is(err, ErrUnauthorized) {
+		return
+	}
+	if err != nil {
+		//The token is not valid anymore, login again
+		logging.Debugf("gateway rejected the token, login again: %v", err)
+
+		err = s.e.RefreshToken(ctx)
+		if err != nil {
+			return
+		}
+
+		err = s.e.GetLocalSessionCookie(ctx)
+		if err != nil {
+			return
+		}
+	}
+
+	s.authenticated = true
+	s.gen++
+	atomic.AddUint64(&s.e.stats.SessionRenewals, 1)
+
+	return
+}
+
+// ensure authenticates if the session is not valid
+func (s *Session) ensure(ctx context.Context) error {
+	_, err := s.current(ctx)
+	return err
+}
+
+// current returns the generation of the session, after authenticating if it
+// is not valid
+func (s *Session) current(ctx context.Context) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.authenticated {
+		return s.gen, nil
+	}
+	return s.gen, s.authenticate(ctx)
+}
+
+// renew authenticates again after the gateway rejected the session gen. It
+// does nothing if another request already renewed it.
+func (s *Session) renew(ctx context.Context, gen uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.authenticated && s.gen != gen {
+		return nil
+	}
+	return s.authenticate(ctx)
+}
+
+// do runs a request with the current session. If the gateway rejects the
+// session, a new one is created and the request is done again. If the gateway
+// can not be reached, it is looked for on the network and the request is done
+// again at its new address. Only the authentication is serialized, requests
+// run concurrently.
+func (s *Session) do(ctx context.Context, req func() error) (err error) {
+	gen, err := s.current(ctx)
+	if err != nil {
+		return
+	}
+
+	err = req()
+	if s.e.rediscoverAfter(ctx, err) {
+		err = req()
+	}
+	if !errors.Is(err, ErrUnauthorized) {
+		return
+	}
+
+	logging.Debugln("gateway session expired, authenticate again")
+
+	err = s.renew(ctx, gen)
+	if err != nil {
+		return
+	}
+
+	return req()
+}
+
+// Close saves the credentials, see Envoy.Close
+func (s *Session) Close() {
+	s.e.Close()
+}
+
+func (s *Session) Production(ctx context.Context) (p *Production, err error) {
+	err = s.do(ctx, func() (err error) {
+		p, err = s.e.Production(ctx)
+		return
+	})
+	return
+}
+
+func (s *Session) Home(ctx context.Context) (h *Home, err error) {
+	err = s.do(ctx, func() (err error) {
+		h, err = s.e.Home(ctx)
+		return
+	})
+	return
+}
+
+func (s *Session) Inventory(ctx context.Context) (i *[]Inventory, err error) {
+	err = s.do(ctx, func() (err error) {
+		i, err = s.e.Inventory(ctx)
+		return
+	})
+	return
+}
+
+func (s *Session) Info(ctx context.Context) (i *EnvoyInfo, err error) {
+	err = s.do(ctx, func() (err error) {
+		i, err = s.e.Info(ctx)
+		return
+	})
+	return
+}
+
+func (s *Session) Inverters(ctx context.Context) (i *[]Inverter, err error) {
+	err = s.do(ctx, func() (err error) {
+		i, err = s.e.Inverters(ctx)
+		return
+	})
+	return
+}
+
+func (s *Session) EnsembleInventory(ctx context.Context) (i *[]EnsembleInventory, err error) {
+	err = s.do(ctx, func() (err error) {
+		i, err = s.e.EnsembleInventory(ctx)
+		return
+	})
+	return
+}
+
+func (s *Session) EnsemblePower(ctx context.Context) (p *EnsemblePower, err error) {
+	err = s.do(ctx, func() (err error) {
+		p, err = s.e.EnsemblePower(ctx)
+		return
+	})
+	return
+}
+
+func (s *Session) EnsembleSecctrl(ctx context.Context) (c *EnsembleSecctrl, err error) {
+	err = s.do(ctx, func() (err error) {
+		c, err = s.e.EnsembleSecctrl(ctx)
+		return
+	})
+	return
+}
+
+func (s *Session) EnsembleRelay(ctx context.Context) (r *EnsembleRelay, err error) {
+	err = s.do(ctx, func() (err error) {
+		r, err = s.e.EnsembleRelay(ctx)
+		return
+	})
+	return
+}
+
+func (s *Session) Battery(ctx context.Context) (b *BatteryStatus, err error) {
+	err = s.do(ctx, func() (err error) {
+		b, err = s.e.Battery(ctx)
+		return
+	})
+	return
+}
+
+func (s *Session) Meters(ctx context.Context) (m *[]Meter, err error) {
+	err = s.do(ctx, func() (err error) {
+		m, err = s.e.Meters(ctx)
+		return
+	})
+	return
+}
+
+func (s *Session) MeterReadings(ctx context.Context) (r *[]MeterReading, err error) {
+	err = s.do(ctx, func() (err error) {
+		r, err = s.e.MeterReadings(ctx)
+		return
+	})
+	return
+}
+
+func (s *Session) LiveData(ctx context.Context) (d *LiveData, err error) {
+	err = s.do(ctx, func() (err error) {
+		d, err = s.e.LiveData(ctx)
+		return
+	})
+	return
+}
+
+func (s *Session) Now(ctx context.Context) (production, consumption, net float64, err error) {
+	err = s.do(ctx, func() (err error) {
+		production, consumption, net, err = s.e.Now(ctx)
+		return
+	})
+	return
+}
+
+func (s *Session) Today(ctx context.Context) (production, consumption, net float64, err error) {
+	err = s.do(ctx, func() (err error) {
+		production, consumption, net, err = s.e.Today(ctx)
+		return
+	})
+	return
+}
+
+func (s *Session) SystemMax(ctx context.Context) (max uint64, err error) {
+	err = s.do(ctx, func() (err error) {
+		max, err = s.e.SystemMax(ctx)
+		return
+	})
+	return
+}
@@ -0,0 +1,312 @@
+package envoy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Credentials holds everything needed to reach and authenticate on a gateway
+type Credentials struct {
+	Host             string `json:"host"`
+	Username         string `json:"username"`
+	Password         string `json:"password"`
+	Serial           string `json:"serial"`
+	JWTToken         string `json:"jwt_token"`
+	TokenGeneratedAt int64  `json:"token_generation_time,omitempty"`
+	TokenExpiry      int64  `json:"token_expires_at,omitempty"`
+	JWTExpiry        int64  `json:"jwt_exp,omitempty"`
+	// CertFingerprint is the sha256 of the gateway certificate, pinned on
+	// first use
+	CertFingerprint string `json:"cert_fingerprint,omitempty"`
+}
+
+// CredentialStore persists the credentials and the token between runs.
+// Load returns an error wrapping os.ErrNotExist if nothing was saved yet.
+type CredentialStore interface {
+	Load() (*Credentials, error)
+	Save(c *Credentials) error
+}
+
+// ErrReadOnlyStore is returned when saving in a read only store
+var ErrReadOnlyStore = errors.New("credential store is read only")
+
+// mergeCredentials returns base with the non empty fields of over
+func mergeCredentials(base, over Credentials) Credentials {
+	if over.Host != "" {
+		base.Host = over.Host
+	}
+	if over.Username != "" {
+		base.Username = over.Username
+	}
+	if over.Password != "" {
+		base.Password = over.Password
+	}
+	if over.Serial != "" {
+		base.Serial = over.Serial
+	}
+	if over.CertFingerprint != "" {
+		base.CertFingerprint = over.CertFingerprint
+	}
+	if over.JWTToken != "" {
+		base.JWTToken = over.JWTToken
+		base.TokenGeneratedAt = over.TokenGeneratedAt
+		base.TokenExpiry = over.TokenExpiry
+		base.JWTExpiry = over.JWTExpiry
+	}
+	return base
+}
+
+// DefaultGateway is the name of the gateway used when none is given. Its
+// cache and variables have no gateway name in them.
+const DefaultGateway = "default"
+
+// DefaultCacheFile returns the cache file used by the command line tools. It is
+// in $ENVOY_CACHE_PATH or in ~/.cache/envoy
+func DefaultCacheFile() string {
+	return CacheFile(DefaultGateway)
+}
+
+// CacheFile returns the cache file of a named gateway, it is next to
+// DefaultCacheFile
+func CacheFile(gateway string) string {
+	path := os.Getenv("ENVOY_CACHE_PATH")
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err == nil && home != "" {
+			path = fmt.Sprintf("%s/.cache/envoy", home)
+		}
+	}
+
+	if path == "" {
+		path = "./"
+	}
+
+	if gateway == "" || gateway == DefaultGateway {
+		return filepath.Join(path, "envoy.cache")
+	}
+	return filepath.Join(path, "envoy-"+gateway+".cache")
+}
+
+// FileStore keeps the credentials in a json file only readable by its owner
+type FileStore struct {
+	path string
+}
+
+// NewFileStore creates a store for the given file
+func NewFileStore(path string) *FileStore {
+	return &FileStore{path: path}
+}
+
+func (s *FileStore) Load() (*Credentials, error) {
+	b, err := os.ReadFile(s.path)
+	if err != nil {
+		return nil, err
+	}
+
+	var c Credentials
+	err = json.Unmarshal(b, &c)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal cache file failed: %w", err)
+	}
+
+	return &c, nil
+}
+
+func (s *FileStore) Save(c *Credentials) error {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return fmt.Errorf("marshal cache file failed: %w", err)
+	}
+
+	return writeFileAtomic(s.path, b)
+}
+
+// writeFileAtomic writes the file with 0600 permissions. Data is written in a
+// temporary file first and renamed, a crash can not leave a truncated file.
+func writeFileAtomic(path string, b []byte) (err error) {
+	dir := filepath.Dir(path)
+
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return
+	}
+
+	f, err := os.CreateTemp(dir, "."+filepath.Base(path)+".*")
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	err = f.Chmod(0600)
+	if err != nil {
+		return
+	}
+
+	_, err = f.Write(b)
+	if err != nil {
+		return
+	}
+
+	err = f.Sync()
+	if err != nil {
+		return
+	}
+
+	err = f.Close()
+	if err != nil {
+		return
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// NewCacheStore opens the cache of a gateway, at CacheFile(gateway) when path
+// is empty, and layers the environment and systemd credentials over it like
+// NewGatewayStore. kind is "file" or "encrypted", the encrypted cache is keyed
+// with passphrase or with the machine id when it is empty.
+func NewCacheStore(gateway, path, kind, passphrase string) (*LayeredStore, error) {
+	if path == "" {
+		path = CacheFile(gateway)
+	}
+
+	var (
+		cache CredentialStore
+		err   error
+	)
+
+	switch kind {
+	case "", "file":
+		cache = NewFileStore(path)
+	case "encrypted":
+		if passphrase != "" {
+			cache, err = NewEncryptedFileStore(path, passphrase)
+		} else {
+			cache, err = NewMachineKeyFileStore(path)
+		}
+	default:
+		err = fmt.Errorf("unknown store type %q", kind)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return NewGatewayStore(gateway, cache), nil
+}
+
+// NewDefaultStore layers the environment (ENVOY_HOST, ENVOY_USERNAME,
+// ENVOY_PASSWORD, ENVOY_SERIAL) and the systemd credentials over cache
+func NewDefaultStore(cache CredentialStore) *LayeredStore {
+	return NewGatewayStore(DefaultGateway, cache)
+}
+
+// NewGatewayStore is NewDefaultStore for a named gateway. Its variables are
+// prefixed with ENVOY_<NAME>_ and its systemd credentials with <name>., like
+// ENVOY_BARN_PASSWORD or barn.password.
+func NewGatewayStore(gateway string, cache CredentialStore) *LayeredStore {
+	envPrefix, credPrefix := "ENVOY_", ""
+	if gateway != "" && gateway != DefaultGateway {
+		envPrefix += strings.ToUpper(strings.ReplaceAll(gateway, "-", "_")) + "_"
+		credPrefix = gateway + "."
+	}
+
+	sources := []CredentialStore{NewEnvStore(envPrefix)}
+	if dir := os.Getenv("CREDENTIALS_DIRECTORY"); dir != "" {
+		sources = append(sources, &SecretDirStore{dir: dir, prefix: credPrefix})
+	}
+	return NewLayeredStore(cache, sources...)
+}
+
+// LayeredStore reads the credentials from several stores. The token is saved
+// in a writable cache, and the credentials given by the read only sources take
+// precedence over the cached ones.
+type LayeredStore struct {
+	cache   CredentialStore
+	sources []CredentialStore
+}
+
+// NewLayeredStore creates a store saving in cache and reading from cache and
+// all sources, in that order.
+func NewLayeredStore(cache CredentialStore, sources ...CredentialStore) *LayeredStore {
+	return &LayeredStore{
+		cache:   cache,
+		sources: sources,
+	}
+}
+
+func (s *LayeredStore) Load() (*Credentials, error) {
+	var c Credentials
+
+	cached, err := s.cache.Load()
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if cached != nil {
+		c = *cached
+	}
+
+	for _, src := range s.sources {
+		sc, err := src.Load()
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		if sc != nil {
+			c = mergeCredentials(c, *sc)
+		}
+	}
+
+	return &c, nil
+}
+
+// Save writes c in the cache. The fields given by the read only sources are
+// not written, the cache keeps its own value for them: a password coming from
+// the environment never ends up on disk.
+func (s *LayeredStore) Save(c *Credentials) error {
+	var cached Credentials
+	cc, err := s.cache.Load()
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if cc != nil {
+		cached = *cc
+	}
+
+	out := *c
+	for _, src := range s.sources {
+		sc, err := src.Load()
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if sc != nil {
+			out = withoutSourced(out, cached, *sc)
+		}
+	}
+
+	return s.cache.Save(&out)
+}
+
+// withoutSourced returns c with the cached value for every field src gives,
+// unless it was changed since it was loaded
+func withoutSourced(c, cached, src Credentials) Credentials {
+	if src.Host != "" && c.Host == src.Host {
+		c.Host = cached.Host
+	}
+	if src.Username != "" && c.Username == src.Username {
+		c.Username = cached.Username
+	}
+	if src.Password != "" && c.Password == src.Password {
+		c.Password = cached.Password
+	}
+	if src.Serial != "" && c.Serial == src.Serial {
+		c.Serial = cached.Serial
+	}
+	return c
+}
@@ -0,0 +1,146 @@
+package envoy
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	kCryptMagic    = "ENVOYENC1"
+	kCryptSaltSize = 16
+)
+
+var machineIdFiles = []string{
+	"/etc/machine-id",
+	"/var/lib/dbus/machine-id",
+}
+
+// EncryptedFileStore keeps the credentials in a file encrypted with AES-GCM.
+// The key is derived from a passphrase with scrypt.
+type EncryptedFileStore struct {
+	path       string
+	passphrase []byte
+}
+
+// NewEncryptedFileStore creates an encrypted store for the given file
+func NewEncryptedFileStore(path, passphrase string) (*EncryptedFileStore, error) {
+	if passphrase == "" {
+		return nil, errors.New("empty passphrase")
+	}
+
+	return &EncryptedFileStore{
+		path:       path,
+		passphrase: []byte(passphrase),
+	}, nil
+}
+
+// NewMachineKeyFileStore creates an encrypted store using the machine id as
+// passphrase. The file can only be read back on the same machine.
+func NewMachineKeyFileStore(path string) (*EncryptedFileStore, error) {
+	for _, f := range machineIdFiles {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			continue
+		}
+
+		if id := strings.TrimSpace(string(b)); id != "" {
+			return NewEncryptedFileStore(path, id)
+		}
+	}
+
+	return nil, errors.New("no machine id found")
+}
+
+func (s *EncryptedFileStore) aead(salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key(s.passphrase, salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func (s *EncryptedFileStore) Load() (*Credentials, error) {
+	b, err := os.ReadFile(s.path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.HasPrefix(b, []byte(kCryptMagic)) {
+		return nil, fmt.Errorf("%s is not an encrypted cache file", s.path)
+	}
+	b = b[len(kCryptMagic):]
+
+	if len(b) < kCryptSaltSize {
+		return nil, errors.New("encrypted cache file is truncated")
+	}
+	salt, b := b[:kCryptSaltSize], b[kCryptSaltSize:]
+
+	gcm, err := s.aead(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(b) < gcm.NonceSize() {
+		return nil, errors.New("encrypted cache file is truncated")
+	}
+	nonce, b := b[:gcm.NonceSize()], b[gcm.NonceSize():]
+
+	plain, err := gcm.Open(nil, nonce, b, []byte(kCryptMagic))
+	if err != nil {
+		return nil, fmt.Errorf("decrypt cache file failed, wrong key?: %w", err)
+	}
+
+	var c Credentials
+	err = json.Unmarshal(plain, &c)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal cache file failed: %w", err)
+	}
+
+	return &c, nil
+}
+
+func (s *EncryptedFileStore) Save(c *Credentials) error {
+	plain, err := json.Marshal(c)
+	if err != nil {
+		return fmt.Errorf("marshal cache file failed: %w", err)
+	}
+
+	salt := make([]byte, kCryptSaltSize)
+	if _, err = io.ReadFull(rand.Reader, salt); err != nil {
+		return err
+	}
+
+	gcm, err := s.aead(salt)
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+
+	var b bytes.Buffer
+	b.WriteString(kCryptMagic)
+	b.Write(salt)
+	b.Write(nonce)
+	b.Write(gcm.Seal(nil, nonce, plain, []byte(kCryptMagic)))
+
+	return writeFileAtomic(s.path, b.Bytes())
+}
@@ -0,0 +1,84 @@
+package envoy
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// EnvStore reads the credentials from environment variables:
+// <prefix>HOST, <prefix>USERNAME, <prefix>PASSWORD and <prefix>SERIAL.
+// It is read only.
+type EnvStore struct {
+	prefix string
+}
+
+// NewEnvStore creates a store reading variables starting with prefix
+func NewEnvStore(prefix string) *EnvStore {
+	return &EnvStore{prefix: prefix}
+}
+
+func (s *EnvStore) Load() (*Credentials, error) {
+	return &Credentials{
+		Host:     os.Getenv(s.prefix + "HOST"),
+		Username: os.Getenv(s.prefix + "USERNAME"),
+		Password: os.Getenv(s.prefix + "PASSWORD"),
+		Serial:   os.Getenv(s.prefix + "SERIAL"),
+	}, nil
+}
+
+func (s *EnvStore) Save(c *Credentials) error {
+	return ErrReadOnlyStore
+}
+
+// SecretDirStore reads the credentials from one file per value in a directory:
+// host, username, password and serial. Missing files are ignored. This is the
+// layout used by systemd LoadCredential= and by container secrets. It is read
+// only.
+type SecretDirStore struct {
+	dir    string
+	prefix string
+}
+
+// NewSecretDirStore creates a store reading files in dir
+func NewSecretDirStore(dir string) *SecretDirStore {
+	return &SecretDirStore{dir: dir}
+}
+
+// NewSystemdCredentialStore creates a store reading the credentials passed by
+// systemd with LoadCredential=. It returns nil if the program was not started
+// with credentials.
+func NewSystemdCredentialStore() *SecretDirStore {
+	dir := os.Getenv("CREDENTIALS_DIRECTORY")
+	if dir == "" {
+		return nil
+	}
+	return NewSecretDirStore(dir)
+}
+
+func (s *SecretDirStore) Load() (*Credentials, error) {
+	var c Credentials
+
+	for name, v := range map[string]*string{
+		"host":     &c.Host,
+		"username": &c.Username,
+		"password": &c.Password,
+		"serial":   &c.Serial,
+	} {
+		b, err := os.ReadFile(filepath.Join(s.dir, s.prefix+name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read secret %s failed: %w", name, err)
+		}
+		*v = strings.TrimSpace(string(b))
+	}
+
+	return &c, nil
+}
+
+func (s *SecretDirStore) Save(c *Credentials) error {
+	return ErrReadOnlyStore
+}
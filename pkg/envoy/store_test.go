@@ -0,0 +1,199 @@
+package envoy
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEncryptedFileStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "envoy.cache")
+	creds := Credentials{
+		Host:             "envoy.local",
+		Username:         "user@example.com",
+		Password:         "secret password",
+		Serial:           "123456789012",
+		JWTToken:         jwt(`{"exp":1700000000}`),
+		TokenGeneratedAt: 1690000000,
+		TokenExpiry:      1700000000,
+		JWTExpiry:        1700000000,
+		CertFingerprint:  "ab:cd",
+	}
+
+	s, err := NewEncryptedFileStore(path, "passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Save(&creds); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(b, []byte(kCryptMagic)) {
+		t.Error("missing magic")
+	}
+	if bytes.Contains(b, []byte(creds.Password)) || bytes.Contains(b, []byte(creds.Username)) {
+		t.Error("credentials are stored in clear")
+	}
+
+	got, err := s.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *got != creds {
+		t.Errorf("loaded %+v, want %+v", *got, creds)
+	}
+
+	wrong, err := NewEncryptedFileStore(path, "other passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = wrong.Load(); err == nil || !strings.Contains(err.Error(), "wrong key") {
+		t.Errorf("load with a wrong passphrase: err = %v", err)
+	}
+
+	if _, err = NewEncryptedFileStore(path, ""); err == nil {
+		t.Error("empty passphrase accepted")
+	}
+}
+
+func TestEncryptedFileStoreInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{name: "plain json", data: []byte(`{"host":"envoy.local"}`)},
+		{name: "no salt", data: []byte(kCryptMagic + "salt")},
+		{name: "no nonce", data: []byte(kCryptMagic + "0123456789abcdef" + "nonce")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "envoy.cache")
+			if err := os.WriteFile(path, tt.data, 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			s, _ := NewEncryptedFileStore(path, "passphrase")
+			if _, err := s.Load(); err == nil {
+				t.Error("invalid file loaded")
+			}
+		})
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	tests := []struct {
+		name     string
+		path     string
+		existing os.FileMode
+	}{
+		{name: "new file", path: "envoy.cache"},
+		{name: "missing directory", path: "a/b/envoy.cache"},
+		{name: "replace readable file", path: "envoy.cache", existing: 0644},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, tt.path)
+			if tt.existing != 0 {
+				if err := os.WriteFile(path, []byte("old content"), tt.existing); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := writeFileAtomic(path, []byte("new")); err != nil {
+				t.Fatal(err)
+			}
+
+			fi, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fi.Mode().Perm() != 0600 {
+				t.Errorf("mode %v, want 0600", fi.Mode().Perm())
+			}
+
+			b, _ := os.ReadFile(path)
+			if string(b) != "new" {
+				t.Errorf("content %q, want %q", b, "new")
+			}
+
+			entries, _ := os.ReadDir(filepath.Dir(path))
+			if len(entries) != 1 {
+				t.Errorf("%d files left in the directory, want 1", len(entries))
+			}
+		})
+	}
+}
+
+func TestLayeredStoreSave(t *testing.T) {
+	secrets := t.TempDir()
+	if err := os.WriteFile(filepath.Join(secrets, "barn.serial"), []byte("222222222222\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("ENVOY_BARN_PASSWORD", "env password")
+
+	tests := []struct {
+		name   string
+		cached *Credentials
+		save   Credentials
+		want   Credentials
+	}{
+		{
+			name: "sourced values are not written",
+			save: Credentials{Host: "envoy.local", Password: "env password", Serial: "222222222222", JWTToken: "token"},
+			want: Credentials{Host: "envoy.local", JWTToken: "token"},
+		},
+		{
+			name:   "cache keeps its own values",
+			cached: &Credentials{Password: "cached password", Serial: "111111111111"},
+			save:   Credentials{Password: "env password", Serial: "222222222222", JWTToken: "token"},
+			want:   Credentials{Password: "cached password", Serial: "111111111111", JWTToken: "token"},
+		},
+		{
+			name:   "changed values are written",
+			cached: &Credentials{Password: "cached password"},
+			save:   Credentials{Password: "new password", Serial: "333333333333"},
+			want:   Credentials{Password: "new password", Serial: "333333333333"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := NewFileStore(filepath.Join(t.TempDir(), "envoy-barn.cache"))
+			if tt.cached != nil {
+				if err := cache.Save(tt.cached); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			s := NewLayeredStore(cache, NewEnvStore("ENVOY_BARN_"), &SecretDirStore{dir: secrets, prefix: "barn."})
+			if err := s.Save(&tt.save); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := cache.Load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *got != tt.want {
+				t.Errorf("cached %+v, want %+v", *got, tt.want)
+			}
+
+			loaded, err := s.Load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if loaded.Password != "env password" || loaded.Serial != "222222222222" {
+				t.Errorf("sources do not take precedence: %+v", *loaded)
+			}
+		})
+	}
+}
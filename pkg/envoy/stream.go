@@ -0,0 +1,125 @@
+package envoy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	kEnvoyStreamMeterUrl = "https://%s/stream/meter"
+
+	//the gateway sends a sample every second, consider the stream dead after that
+	kStreamIdleTimeout = 10 * time.Second
+	kStreamRetryMin    = time.Second
+	kStreamRetryMax    = 30 * time.Second
+)
+
+// Power returns the active power of all phases
+func (s StreamSet) Power() float64 {
+	return s.A.P + s.B.P + s.C.P
+}
+
+// streamMeter reads samples from /stream/meter until the connection is closed
+// or ctx is cancelled
+func (e *Envoy) streamMeter(ctx context.Context, out chan<- Stream) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	resp, err := e.open(ctx, fmt.Sprintf(kEnvoyStreamMeterUrl, e.Host()))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	//Abort the request if the gateway stops sending data
+	idle := time.AfterFunc(kStreamIdleTimeout, cancel)
+	defer idle.Stop()
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		idle.Reset(kStreamIdleTimeout)
+
+		//data is sent as server sent events: "data: {...}"
+		line := bytes.TrimSpace(scanner.Bytes())
+		line = bytes.TrimSpace(bytes.TrimPrefix(line, []byte("data:")))
+		if len(line) == 0 || line[0] != '{' {
+			continue
+		}
+
+		var s Stream
+		if err := json.Unmarshal(line, &s); err != nil {
+			logging.Debugf("stream: unmarshal failed: %v", err)
+			continue
+		}
+
+		select {
+		case out <- s:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	return errors.New("stream closed by gateway")
+}
+
+// StreamMeter reads the live meter data from the gateway. Samples are sent on
+// the returned channel until ctx is cancelled, the channel is then closed. The
+// stream is opened again if the gateway drops it, and the session is renewed
+// if needed.
+func (s *Session) StreamMeter(ctx context.Context) (<-chan Stream, error) {
+	err := s.ensure(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan Stream)
+
+	go func() {
+		defer close(out)
+
+		retry := kStreamRetryMin
+
+		for {
+			start := time.Now()
+
+			//the session is renewed and the gateway looked for on the
+			//network like for any other request
+			err := s.do(ctx, func() error {
+				return s.e.streamMeter(ctx, out)
+			})
+			if ctx.Err() != nil {
+				return
+			}
+
+			//reset the backoff if the stream was working for a while
+			if time.Since(start) > kStreamRetryMax {
+				retry = kStreamRetryMin
+			}
+
+			logging.Warnf("meter stream interrupted, reconnecting in %v: %v", retry, err)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(retry):
+			}
+
+			retry *= 2
+			if retry > kStreamRetryMax {
+				retry = kStreamRetryMax
+			}
+
+		}
+	}()
+
+	return out, nil
+}
@@ -0,0 +1,136 @@
+package envoy
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// hosts of the Enphase cloud, their certificates are verified normally
+const kEnlightenDomain = "enphaseenergy.com"
+
+var (
+	// ErrCertificateMismatch is returned when the gateway certificate is not
+	// the one pinned on first use, or is issued to another serial
+	ErrCertificateMismatch = errors.New("gateway certificate mismatch")
+
+	//gateway serials are only digits
+	serialRe = regexp.MustCompile(`^[0-9]{6,}$`)
+)
+
+// CertFingerprint returns the sha256 fingerprint of a certificate, in hex
+func CertFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+func isCloudHost(host string) bool {
+	return host == kEnlightenDomain || strings.HasSuffix(host, "."+kEnlightenDomain)
+}
+
+// dialTLS opens TLS connections. The Enphase cloud is verified with the
+// system roots, everything else is the gateway and is verified with
+// verifyGateway.
+func (e *Envoy) dialTLS(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	d := net.Dialer{Timeout: 10 * time.Second}
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	tc := tls.Client(conn, e.tlsConfig(host))
+	if err = tc.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tc, nil
+}
+
+// tlsConfig returns the configuration of a connection to host
+func (e *Envoy) tlsConfig(host string) *tls.Config {
+	cfg := &tls.Config{ServerName: host}
+	if !isCloudHost(host) {
+		//the gateway certificate is self signed, it is checked by
+		//verifyGateway instead
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyConnection = e.verifyGateway
+	}
+	return cfg
+}
+
+// verifyGateway checks that the certificate is the one seen on first use and
+// that it was issued to the serial of the gateway, if it names a serial. A new
+// pin is only kept in memory, it is saved by savePin once a request went
+// through, no store I/O is done during the handshake.
+func (e *Envoy) verifyGateway(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return fmt.Errorf("%w: no certificate", ErrCertificateMismatch)
+	}
+	cert := cs.PeerCertificates[0]
+	fp := CertFingerprint(cert)
+
+	e.mu.Lock()
+	serial := e.creds.Serial
+	pinned := e.creds.CertFingerprint
+	e.mu.Unlock()
+
+	if serial != "" {
+		for _, name := range append([]string{cert.Subject.CommonName, cert.Subject.SerialNumber}, cert.DNSNames...) {
+			if serialRe.MatchString(name) && name != serial {
+				return fmt.Errorf("%w: certificate issued to %s, expected %s", ErrCertificateMismatch, name, serial)
+			}
+		}
+	}
+
+	if pinned != "" {
+		if fp != pinned {
+			return fmt.Errorf("%w: gateway presents %s, pinned %s; if the gateway was updated, trust the new certificate with envoy config repin",
+				ErrCertificateMismatch, fp, pinned)
+		}
+		return nil
+	}
+
+	e.mu.Lock()
+	e.creds.CertFingerprint = fp
+	e.pinUnsaved = true
+	e.mu.Unlock()
+
+	logging.Infof("pinned gateway certificate %s", fp)
+
+	return nil
+}
+
+// savePin saves the certificate pinned during the last handshake, it is
+// called after a successful request to the gateway
+func (e *Envoy) savePin() {
+	e.mu.Lock()
+	unsaved := e.pinUnsaved
+	e.pinUnsaved = false
+	e.mu.Unlock()
+
+	if unsaved {
+		e.save()
+	}
+}
+
+// PinnedFingerprint returns the fingerprint of the gateway certificate pinned
+// on first use, empty if none was seen yet
+func (e *Envoy) PinnedFingerprint() string {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	return e.creds.CertFingerprint
+}
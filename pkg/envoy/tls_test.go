@@ -0,0 +1,190 @@
+package envoy
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSerial = "123456789012"
+
+// selfSigned creates a certificate for 127.0.0.1 like the one of a gateway,
+// issued to cn
+func selfSigned(t *testing.T, cn string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{cn},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// newGateway starts a server answering info.xml with the given certificate
+func newGateway(t *testing.T, cert tls.Certificate) *httptest.Server {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<envoy_info><device><sn>` + testSerial + `</sn></device></envoy_info>`))
+	}))
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	//rejected handshakes are expected
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestGatewayCertificate(t *testing.T) {
+	tests := []struct {
+		name    string
+		cn      string
+		pinned  string
+		wantErr string
+		//wantPin is empty when the pin must be the certificate of the server
+		wantPin string
+	}{
+		{
+			name: "first use",
+			cn:   testSerial,
+		},
+		{
+			name: "no serial in the certificate",
+			cn:   "envoy",
+		},
+		{
+			name:    "fingerprint mismatch",
+			cn:      testSerial,
+			pinned:  strings.Repeat("00", 32),
+			wantErr: "config repin",
+			wantPin: strings.Repeat("00", 32),
+		},
+		{
+			name:    "other serial",
+			cn:      "999999999999",
+			wantErr: "issued to 999999999999",
+			wantPin: "none",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cert := selfSigned(t, tt.cn)
+			srv := newGateway(t, cert)
+			leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+			fp := CertFingerprint(leaf)
+
+			store := NewFileStore(filepath.Join(t.TempDir(), "envoy.cache"))
+			if tt.pinned != "" {
+				if err := store.Save(&Credentials{CertFingerprint: tt.pinned}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			e, err := New(
+				WithHost(srv.Listener.Addr().String()),
+				WithSerial(testSerial),
+				WithStore(store),
+				WithRetryPolicy(RetryPolicy{Attempts: 1}),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = e.Info(context.Background())
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("info: %v", err)
+			}
+			if tt.wantErr != "" {
+				if !errors.Is(err, ErrCertificateMismatch) || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want a certificate mismatch with %q", err, tt.wantErr)
+				}
+				if tt.pinned != "" && !strings.Contains(err.Error(), fp) {
+					t.Errorf("err = %v, want the new fingerprint %s", err, fp)
+				}
+			}
+
+			want := tt.wantPin
+			switch want {
+			case "":
+				want = fp
+			case "none":
+				want = ""
+			}
+			if got := e.PinnedFingerprint(); got != want {
+				t.Errorf("pinned %q, want %q", got, want)
+			}
+
+			saved, err := store.Load()
+			if want == "" && err == nil && saved.CertFingerprint != "" {
+				t.Errorf("saved pin %q, want none", saved.CertFingerprint)
+			}
+			if want != "" && (err != nil || saved.CertFingerprint != want) {
+				t.Errorf("saved pin %v (%v), want %q", saved, err, want)
+			}
+		})
+	}
+}
+
+func TestCloudCertificateVerified(t *testing.T) {
+	srv := newGateway(t, selfSigned(t, "enlighten.enphaseenergy.com"))
+	e, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host    string
+		wantErr bool
+	}{
+		{host: "enlighten.enphaseenergy.com", wantErr: true},
+		{host: "127.0.0.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			err = tls.Client(conn, e.tlsConfig(tt.host)).Handshake()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("handshake err = %v, want error %v", err, tt.wantErr)
+			}
+
+			var unknown x509.UnknownAuthorityError
+			if tt.wantErr && !errors.As(err, &unknown) {
+				t.Errorf("err = %v, want an unknown authority", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,250 @@
+package envoy
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	//Refresh margin used when the token lifetime is unknown
+	kTokenRefreshMargin = time.Hour
+	//Never sleep longer than that in the refresh goroutine, the token may have been changed meanwhile
+	kTokenRefreshMaxWait = time.Hour
+	kTokenRetryMin       = time.Minute
+	kTokenRetryMax       = 30 * time.Minute
+)
+
+func parseJWTClaims(token string) (*jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed jwt token")
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil, err
+	}
+
+	var c jwtClaims
+	err = json.Unmarshal(b, &c)
+	if err != nil {
+		return nil, err
+	}
+
+	return &c, nil
+}
+
+func (e *Envoy) token() string {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.creds.JWTToken
+}
+
+// TokenExpiresAt returns the expiry of the current token. It is the earliest of
+// the expiry given by enlighten and the exp claim of the jwt. A zero time is
+// returned when it is unknown.
+func (e *Envoy) TokenExpiresAt() time.Time {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.tokenExpiresAt()
+}
+
+func (e *Envoy) tokenExpiresAt() time.Time {
+	exp := e.creds.TokenExpiry
+	if e.creds.JWTExpiry > 0 && (exp == 0 || e.creds.JWTExpiry < exp) {
+		exp = e.creds.JWTExpiry
+	}
+	if exp == 0 {
+		return time.Time{}
+	}
+	return time.Unix(exp, 0)
+}
+
+// tokenRefreshTime returns when the token should be renewed. The token is
+// refreshed when 90% of its lifetime has been used.
+func (e *Envoy) tokenRefreshTime() time.Time {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if e.creds.JWTToken == "" {
+		return time.Time{}
+	}
+
+	exp := e.tokenExpiresAt()
+	if exp.IsZero() {
+		//no idea when this token expires, keep it until the gateway rejects it
+		return time.Now().Add(kTokenRefreshMaxWait)
+	}
+
+	margin := kTokenRefreshMargin
+	if e.creds.TokenGeneratedAt > 0 && e.creds.TokenGeneratedAt < exp.Unix() {
+		margin = time.Duration(exp.Unix()-e.creds.TokenGeneratedAt) * time.Second / 10
+	}
+
+	return exp.Add(-margin)
+}
+
+func (e *Envoy) tokenUsable() bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if e.creds.JWTToken == "" {
+		return false
+	}
+	exp := e.tokenExpiresAt()
+	return exp.IsZero() || time.Now().Before(exp)
+}
+
+// RefreshToken logs in on enlighten and gets a new token for the gateway.
+// The new token is written to the store. After repeated failures, logins are
+// suspended and ErrCircuitOpen is returned, see BreakerPolicy. Concurrent
+// callers wait for the login in progress and reuse its token.
+func (e *Envoy) RefreshToken(ctx context.Context) (err error) {
+	called := time.Now()
+
+	e.authMu.Lock()
+	defer e.authMu.Unlock()
+
+	//another caller got a token while we were waiting
+	if !e.tokenRefreshedAt.Before(called) && time.Now().Before(e.tokenRefreshTime()) {
+		return nil
+	}
+
+	if err = e.breaker.allow(); err != nil {
+		return
+	}
+
+	err = e.Login(ctx)
+	if err == nil {
+		err = e.retry(ctx, func() error {
+			return e.GetToken(ctx)
+		})
+	}
+	e.breaker.done(err)
+	if err != nil {
+		atomic.AddUint64(&e.stats.AuthFailures, 1)
+		return
+	}
+	atomic.AddUint64(&e.stats.Logins, 1)
+	e.tokenRefreshedAt = time.Now()
+
+	logging.Debugf("new token expires at %v", e.TokenExpiresAt())
+	e.save()
+
+	return
+}
+
+// EnsureToken makes sure a token is available and renews it when it is close
+// to its expiry. A failed renewal is only reported if the current token can not
+// be used anymore.
+func (e *Envoy) EnsureToken(ctx context.Context) error {
+	if time.Now().Before(e.tokenRefreshTime()) {
+		return nil
+	}
+
+	err := e.RefreshToken(ctx)
+	if err != nil && ctx.Err() == nil && e.tokenUsable() {
+		logging.Warnf("Failed to refresh token, keep using current one until %v: %v", e.TokenExpiresAt(), err)
+		return nil
+	}
+
+	return err
+}
+
+// StartTokenRefresh spawns a goroutine that renews the token ahead of its
+// expiry. It runs until ctx is cancelled or StopTokenRefresh is called.
+func (e *Envoy) StartTokenRefresh(ctx context.Context) {
+	if e.cancelRefresh != nil {
+		return
+	}
+
+	ctx, e.cancelRefresh = context.WithCancel(ctx)
+	e.wgRefresh.Add(1)
+	go e.refreshTokenLoop(ctx)
+}
+
+// StopTokenRefresh stops the goroutine started by StartTokenRefresh
+func (e *Envoy) StopTokenRefresh() {
+	if e.cancelRefresh == nil {
+		return
+	}
+
+	e.cancelRefresh()
+	e.wgRefresh.Wait()
+	e.cancelRefresh = nil
+}
+
+func (e *Envoy) refreshTokenLoop(ctx context.Context) {
+	defer e.wgRefresh.Done()
+
+	retry := kTokenRetryMin
+
+	for {
+		wait := time.Until(e.tokenRefreshTime())
+		if wait < 0 {
+			wait = 0
+		}
+		if wait > kTokenRefreshMaxWait {
+			wait = kTokenRefreshMaxWait
+		}
+
+		select {
+		case <-ctx.Done():
+			logging.Debugln("exiting token refresh routine")
+			return
+		case <-time.After(wait):
+		}
+
+		if time.Now().Before(e.tokenRefreshTime()) {
+			continue
+		}
+
+		if err := e.RefreshToken(ctx); err != nil {
+			//Retrying will not help until the credentials are fixed
+			if errors.Is(err, ErrBadCredentials) {
+				retry = kTokenRetryMax
+			}
+			logging.Warnf("Failed to refresh token, retrying in %v: %v", retry, err)
+
+			select {
+			case <-ctx.Done():
+				logging.Debugln("exiting token refresh routine")
+				return
+			case <-time.After(retry):
+			}
+
+			retry *= 2
+			if retry > kTokenRetryMax {
+				retry = kTokenRetryMax
+			}
+			continue
+		}
+
+		retry = kTokenRetryMin
+	}
+}
+
+// Stats counts the authentications done by the client
+type Stats struct {
+	// Logins is the number of successful logins on enlighten
+	Logins uint64
+	// AuthFailures is the number of failed logins on enlighten
+	AuthFailures uint64
+	// SessionRenewals is the number of new sessions opened on the gateway
+	SessionRenewals uint64
+}
+
+// Stats returns the authentication counters
+func (e *Envoy) Stats() Stats {
+	return Stats{
+		Logins:          atomic.LoadUint64(&e.stats.Logins),
+		AuthFailures:    atomic.LoadUint64(&e.stats.AuthFailures),
+		SessionRenewals: atomic.LoadUint64(&e.stats.SessionRenewals),
+	}
+}
@@ -0,0 +1,227 @@
+package envoy
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// jwt builds an unsigned token carrying the given claims
+func jwt(claims string) string {
+	return "eyJhbGciOiJFUzI1NiJ9." + base64.RawURLEncoding.EncodeToString([]byte(claims)) + ".c2ln"
+}
+
+// redirectTransport sends every request to the test server, whatever its host
+type redirectTransport struct {
+	target *url.URL
+}
+
+func (t redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	r := req.Clone(req.Context())
+	r.URL.Scheme = t.target.Scheme
+	r.URL.Host = t.target.Host
+	r.Host = t.target.Host
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func TestParseJWTClaims(t *testing.T) {
+	tests := []struct {
+		name    string
+		token   string
+		wantExp int64
+		wantErr bool
+	}{
+		{
+			name:    "exp",
+			token:   jwt(`{"aud":"123456789012","exp":1700000000,"iat":1690000000}`),
+			wantExp: 1700000000,
+		},
+		{
+			name:    "padded payload",
+			token:   "a." + base64.URLEncoding.EncodeToString([]byte(`{"exp":1700000000}`)) + ".b",
+			wantExp: 1700000000,
+		},
+		{
+			name:  "no exp",
+			token: jwt(`{"aud":"123456789012"}`),
+		},
+		{
+			name:    "two parts",
+			token:   "a." + base64.RawURLEncoding.EncodeToString([]byte(`{"exp":1}`)),
+			wantErr: true,
+		},
+		{
+			name:    "empty",
+			token:   "",
+			wantErr: true,
+		},
+		{
+			name:    "bad base64",
+			token:   "a.!!!.b",
+			wantErr: true,
+		},
+		{
+			name:    "bad json",
+			token:   jwt(`{"exp":`),
+			wantErr: true,
+		},
+		{
+			name:    "exp not a number",
+			token:   jwt(`{"exp":"soon"}`),
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := parseJWTClaims(tt.token)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && c.Exp != tt.wantExp {
+				t.Errorf("exp = %d, want %d", c.Exp, tt.wantExp)
+			}
+		})
+	}
+}
+
+func TestTokenRefreshTime(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	exp := now.Add(100 * time.Hour)
+
+	tests := []struct {
+		name  string
+		creds Credentials
+		want  time.Time
+		//the refresh time depends on the current time, compare with a tolerance
+		approx bool
+	}{
+		{
+			name:  "no token",
+			creds: Credentials{},
+		},
+		{
+			name:   "unknown expiry",
+			creds:  Credentials{JWTToken: "t"},
+			want:   now.Add(kTokenRefreshMaxWait),
+			approx: true,
+		},
+		{
+			name:  "90% of the lifetime",
+			creds: Credentials{JWTToken: "t", TokenGeneratedAt: now.Unix(), TokenExpiry: exp.Unix()},
+			want:  now.Add(90 * time.Hour),
+		},
+		{
+			name:  "jwt expires first",
+			creds: Credentials{JWTToken: "t", TokenGeneratedAt: now.Unix(), TokenExpiry: exp.Unix(), JWTExpiry: now.Add(10 * time.Hour).Unix()},
+			want:  now.Add(9 * time.Hour),
+		},
+		{
+			name:  "unknown lifetime",
+			creds: Credentials{JWTToken: "t", JWTExpiry: exp.Unix()},
+			want:  exp.Add(-kTokenRefreshMargin),
+		},
+		{
+			name:  "generated after expiry",
+			creds: Credentials{JWTToken: "t", TokenGeneratedAt: exp.Add(time.Hour).Unix(), TokenExpiry: exp.Unix()},
+			want:  exp.Add(-kTokenRefreshMargin),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &Envoy{creds: tt.creds}
+			got := e.tokenRefreshTime()
+			if tt.approx {
+				if d := got.Sub(tt.want); d < 0 || d > 5*time.Second {
+					t.Errorf("refresh at %v, want about %v", got, tt.want)
+				}
+				return
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("refresh at %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRefreshTokenConcurrent(t *testing.T) {
+	var logins, tokens int32
+	entered := make(chan struct{})
+	release := make(chan struct{})
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/login/login.json":
+			if atomic.AddInt32(&logins, 1) == 1 {
+				close(entered)
+				<-release
+			}
+			fmt.Fprint(w, `{"message":"success","session_id":"s"}`)
+		case "/entrez-auth-token":
+			atomic.AddInt32(&tokens, 1)
+			now := time.Now()
+			exp := now.Add(365 * 24 * time.Hour).Unix()
+			json.NewEncoder(w).Encode(loginToken{
+				GenerationTime: now.Unix(),
+				Token:          jwt(fmt.Sprintf(`{"exp":%d}`, exp)),
+				ExpiresAt:      exp,
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	target, _ := url.Parse(srv.URL)
+	e, err := New(
+		WithSerial("123456789012"),
+		WithCredentials("user", "pass"),
+		WithHTTPClient(&http.Client{Transport: redirectTransport{target}}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const callers = 5
+	errs := make(chan error, callers)
+	var started sync.WaitGroup
+	refresh := func() {
+		started.Done()
+		errs <- e.RefreshToken(context.Background())
+	}
+
+	started.Add(1)
+	go refresh()
+	<-entered
+
+	//the other callers arrive while the first login is in progress
+	started.Add(callers - 1)
+	for i := 1; i < callers; i++ {
+		go refresh()
+	}
+	started.Wait()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	for i := 0; i < callers; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("refresh: %v", err)
+		}
+	}
+
+	if logins != 1 || tokens != 1 {
+		t.Errorf("%d logins and %d token requests, want 1 each", logins, tokens)
+	}
+	if e.token() == "" {
+		t.Error("no token after refresh")
+	}
+}
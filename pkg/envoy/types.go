@@ -0,0 +1,517 @@
+package envoy
+
+import (
+	"encoding/json"
+	"encoding/xml"
+)
+
+type loginManagerToken struct {
+	Message      string `json:"message"`
+	SessionId    string `json:"session_id"`
+	ManagerToken string `json:"manager_token"`
+	IsConsumer   bool   `json:"is_consumer"`
+}
+
+type loginToken struct {
+	GenerationTime int64  `json:"generation_time"`
+	Token          string `json:"token"`
+	ExpiresAt      int64  `json:"expires_at"`
+}
+
+// claims we care about in the jwt token delivered by enlighten
+type jwtClaims struct {
+	Aud         string `json:"aud"`
+	Iss         string `json:"iss"`
+	EnphaseUser string `json:"enphaseUser"`
+	Exp         int64  `json:"exp"`
+	Iat         int64  `json:"iat"`
+}
+
+// from the production endpoint
+type Production struct {
+	Production  []Entry `json:"production"`
+	Consumption []Entry `json:"consumption"`
+	Storage     []Entry `json:"storage"`
+}
+
+// findEntry returns the entry with the given measurement type, nil if none
+func findEntry(entries []Entry, measurementType string) *Entry {
+	for i := range entries {
+		if entries[i].MeasurementType == measurementType {
+			return &entries[i]
+		}
+	}
+	return nil
+}
+
+// ProductionEntry returns the production meter entry, nil if not available
+func (p *Production) ProductionEntry() *Entry {
+	return findEntry(p.Production, "production")
+}
+
+// TotalConsumption returns the total consumption entry, nil if not available
+func (p *Production) TotalConsumption() *Entry {
+	return findEntry(p.Consumption, "total-consumption")
+}
+
+// NetConsumption returns the net consumption entry, nil if not available
+func (p *Production) NetConsumption() *Entry {
+	return findEntry(p.Consumption, "net-consumption")
+}
+
+type Entry struct {
+	Type             string  `json:"type"`
+	ActiveCount      int     `json:"activeCount"`
+	MeasurementType  string  `json:"measurementType"`
+	ReadingTime      int     `json:"readingTime"`
+	WNow             float64 `json:"wNow,omitempty"`
+	WhLifetime       float64 `json:"whLifetime,omitempty"`
+	WhNow            float64 `json:"whNow,omitempty"`
+	VarhLeadLifetime float64 `json:"varhLeadLifetime,omitempty"`
+	VarhLagLifetime  float64 `json:"varhLagLifetime,omitempty"`
+	VahLifetime      float64 `json:"vahLifetime,omitempty"`
+	RmsCurrent       float64 `json:"rmsCurrent,omitempty"`
+	RmsVoltage       float64 `json:"rmsVoltage,omitempty"`
+	ReactPwr         float64 `json:"reactPwr,omitempty"`
+	ApprntPwr        float64 `json:"apprntPwr,omitempty"`
+	PwrFactor        float64 `json:"pwrFactor,omitempty"`
+	WhToday          float64 `json:"whToday,omitempty"`
+	WhLastSevenDays  float64 `json:"whLastSevenDays,omitempty"`
+	VahToday         float64 `json:"vahToday,omitempty"`
+	VarhLeadToday    float64 `json:"varhLeadToday,omitempty"`
+	VarhLagToday     float64 `json:"varhLagToday,omitempty"`
+	State            string  `json:"state,omitempty"`
+	Lines            []Line  `json:"lines,omitempty"`
+
+	//json names of the fields given by the gateway, nil if the entry was
+	//not decoded
+	fields map[string]bool
+}
+
+func (e *Entry) UnmarshalJSON(b []byte) error {
+	type entry Entry
+	var v entry
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return err
+	}
+
+	*e = Entry(v)
+	e.fields = make(map[string]bool, len(fields))
+	for k := range fields {
+		e.fields[k] = true
+	}
+	return nil
+}
+
+// Has returns true if the gateway gave the field with that json name. Each
+// entry type only has some of the fields, the others are left at 0. Entries
+// not decoded from json have all fields.
+func (e *Entry) Has(field string) bool {
+	return e.fields == nil || e.fields[field]
+}
+
+type Line struct {
+	WNow             float64 `json:"wNow"`
+	WhLifetime       float64 `json:"whLifetime"`
+	VarhLeadLifetime float64 `json:"varhLeadLifetime"`
+	VarhLagLifetime  float64 `json:"varhLagLifetime"`
+	VahLifetime      float64 `json:"vahLifetime"`
+	RmsCurrent       float64 `json:"rmsCurrent"`
+	RmsVoltage       float64 `json:"rmsVoltage"`
+	ReactPwr         float64 `json:"reactPwr"`
+	ApprntPwr        float64 `json:"apprntPwr"`
+	PwrFactor        float64 `json:"pwrFactor"`
+	WhToday          float64 `json:"whToday"`
+	WhLastSevenDays  float64 `json:"whLastSevenDays"`
+	VahToday         float64 `json:"vahToday"`
+	VarhLeadToday    float64 `json:"varhLeadToday"`
+	VarhLagToday     float64 `json:"varhLagToday"`
+}
+
+// http://envoy.local/home.json
+type Home struct {
+	SoftwareBuildEpoch int     `json:"software_build_epoch"`
+	IsNonvoy           bool    `json:"is_nonvoy"`
+	DbSize             string  `json:"db_size"`
+	DbPercentFull      string  `json:"db_percent_full"`
+	Timezone           string  `json:"timezone"`
+	CurrentDate        string  `json:"current_date"`
+	CurrentTime        string  `json:"current_time"`
+	Network            Homenet `json:"network"`
+	Tariff             string  `json:"tariff"`
+	Comm               struct {
+		Num   int        `json:"num"`
+		Level int        `json:"level"`
+		Pcu   Homenumlev `json:"pcu"`
+		Acb   Homenumlev `json:"acb"`
+		Nsrb  Homenumlev `json:"nsrb"`
+	} `json:"comm"`
+	Alerts       []interface{} `json:"alerts"` // dunno on this one yet
+	UpdateStatus string        `json:"update_status"`
+}
+
+type Homenumlev struct {
+	Num   int `json:"num"`
+	Level int `json:"level"`
+}
+
+type Homenet struct {
+	WebComm                 bool        `json:"web_comm"`
+	EverReportedToEnlighten bool        `json:"ever_reported_to_enlighten"`
+	LastEnlightenReportTime int         `json:"last_enlighten_report_time"`
+	PrimaryInterface        string      `json:"primary_interface"`
+	Interfaces              []Homenetif `json:"interfaces"`
+}
+
+type Homenetif struct {
+	SignalStrength    int    `json:"signal_strength"`
+	SignalStrengthMax int    `json:"signal_strength_max"`
+	Network           bool   `json:"network,omitempty"`
+	Type              string `json:"type"`
+	Interface         string `json:"interface"`
+	Dhcp              bool   `json:"dhcp"`
+	IP                string `json:"ip"`
+	Carrier           bool   `json:"carrier"`
+	Mac               string `json:"mac,omitempty"`
+	Supported         bool   `json:"supported,omitempty"`
+	Present           bool   `json:"present,omitempty"`
+	Configured        bool   `json:"configured,omitempty"`
+	Status            string `json:"status,omitempty"`
+}
+
+// inventory
+type Inventory struct {
+	Type    string   `json:"type"`
+	Devices []Device `json:"devices"`
+}
+
+// Device is a device of the inventory
+type Device struct {
+	PartNum        string   `json:"part_num"`
+	Installed      string   `json:"installed"`
+	SerialNum      string   `json:"serial_num"`
+	DeviceStatus   []string `json:"device_status"`
+	LastRptDate    string   `json:"last_rpt_date"`
+	AdminState     int      `json:"admin_state"`
+	DevType        int      `json:"dev_type"`
+	CreatedDate    string   `json:"created_date"`
+	ImgLoadDate    string   `json:"img_load_date"`
+	ImgPnumRunning string   `json:"img_pnum_running"`
+	Ptpn           string   `json:"ptpn"`
+	Chaneid        int      `json:"chaneid"`
+	DeviceControl  []struct {
+		Gficlearset bool `json:"gficlearset"`
+	} `json:"device_control"`
+	Producing     bool `json:"producing"`
+	Communicating bool `json:"communicating"`
+	Provisioned   bool `json:"provisioned"`
+	Operating     bool `json:"operating"`
+}
+
+// StreamEntry is a sample of one phase from the stream endpoint
+type StreamEntry struct {
+	P  float64 `json:"p"`
+	Q  float64 `json:"q"`
+	S  float64 `json:"s"`
+	V  float64 `json:"v"`
+	I  float64 `json:"i"`
+	Pf float64 `json:"pf"`
+	F  float64 `json:"f"`
+}
+
+// StreamSet holds the samples of all phases
+type StreamSet struct {
+	A StreamEntry `json:"ph-a"`
+	B StreamEntry `json:"ph-b"`
+	C StreamEntry `json:"ph-c"`
+}
+
+// Stream is the type for the webstream
+type Stream struct {
+	Production       StreamSet `json:"production"`
+	NetConsumption   StreamSet `json:"net-consumption"`
+	TotalConsumption StreamSet `json:"total-consumption"`
+}
+
+type EnvoyInfo struct {
+	XMLName xml.Name `xml:"envoy_info"`
+	Text    string   `xml:",chardata"`
+	Time    string   `xml:"time"`
+	Device  struct {
+		Text     string `xml:",chardata"`
+		Sn       string `xml:"sn"`
+		Pn       string `xml:"pn"`
+		Software string `xml:"software"`
+		Euaid    string `xml:"euaid"`
+		Seqnum   string `xml:"seqnum"`
+		Apiver   string `xml:"apiver"`
+		Imeter   string `xml:"imeter"`
+	} `xml:"device"`
+	Package []struct {
+		Text    string `xml:",chardata"`
+		Name    string `xml:"name,attr"`
+		Pn      string `xml:"pn"`
+		Version string `xml:"version"`
+		Build   string `xml:"build"`
+	} `xml:"package"`
+	BuildInfo struct {
+		Text         string `xml:",chardata"`
+		BuildTimeGmt string `xml:"build_time_gmt"`
+		BuildID      string `xml:"build_id"`
+	} `xml:"build_info"`
+}
+
+// requires authentication
+// http://envoy.local/api/v1/production/inverters
+// uint8 for Watts might be good enough, but mine are hitting 246...
+type Inverter struct {
+	SerialNumber    string `json:"serialNumber"`
+	LastReportDate  uint64 `json:"lastReportDate"`
+	DevType         uint8  `json:"devType"`
+	LastReportWatts int16  `json:"lastReportWatts"`
+	MaxReportWatts  uint16 `json:"maxReportWatts"`
+}
+
+// EnsembleInventory lists the battery devices of one type, ENCHARGE for IQ
+// Batteries and ENPOWER for the system controller
+// http://envoy.local/ivp/ensemble/inventory
+type EnsembleInventory struct {
+	Type    string           `json:"type"`
+	Devices []EnsembleDevice `json:"devices"`
+}
+
+// EnsembleDevice is an IQ Battery or an Enpower. Battery and Enpower fields
+// are only set for their own type.
+type EnsembleDevice struct {
+	PartNum         string   `json:"part_num"`
+	SerialNum       string   `json:"serial_num"`
+	Installed       int64    `json:"installed"`
+	DeviceStatus    []string `json:"device_status"`
+	LastRptDate     int64    `json:"last_rpt_date"`
+	AdminState      int      `json:"admin_state"`
+	AdminStateStr   string   `json:"admin_state_str"`
+	ImgPnumRunning  string   `json:"img_pnum_running"`
+	Operating       bool     `json:"operating"`
+	Communicating   bool     `json:"communicating"`
+	Temperature     float64  `json:"temperature"`
+	CommLevelSubGhz int      `json:"comm_level_sub_ghz"`
+	CommLevel24Ghz  int      `json:"comm_level_2_4_ghz"`
+
+	//IQ Battery
+	SleepEnabled     bool    `json:"sleep_enabled"`
+	PercentFull      float64 `json:"percentFull"`
+	MaxCellTemp      float64 `json:"maxCellTemp"`
+	LedStatus        int     `json:"led_status"`
+	DcSwitchOff      bool    `json:"dc_switch_off"`
+	EnchargeRev      int     `json:"encharge_rev"`
+	EnchargeCapacity float64 `json:"encharge_capacity"`
+
+	//Enpower
+	MainsAdminState   string `json:"mains_admin_state"`
+	MainsOperState    string `json:"mains_oper_state"`
+	EnpwrGridMode     string `json:"Enpwr_grid_mode"`
+	EnchgGridMode     string `json:"Enchg_grid_mode"`
+	EnpwrRelayStateBm int    `json:"Enpwr_relay_state_bm"`
+	EnpwrCurrStateID  int    `json:"Enpwr_curr_state_id"`
+}
+
+// EnsemblePower is the power of each battery
+// http://envoy.local/ivp/ensemble/power
+type EnsemblePower struct {
+	//the gateway really names it "devices:"
+	Devices []EnsemblePowerDevice `json:"devices:"`
+}
+
+// EnsemblePowerDevice is the power of one battery, positive when discharging
+type EnsemblePowerDevice struct {
+	SerialNum        string  `json:"serial_num"`
+	RealPowerMw      float64 `json:"real_power_mw"`
+	ApparentPowerMva float64 `json:"apparent_power_mva"`
+	Soc              float64 `json:"soc"`
+}
+
+// EnsembleSecctrl holds the aggregated state of the batteries
+// http://envoy.local/ivp/ensemble/secctrl
+type EnsembleSecctrl struct {
+	Shutdown                bool    `json:"shutdown"`
+	FreqBiasHz              float64 `json:"freq_bias_hz"`
+	VoltageBiasV            float64 `json:"voltage_bias_v"`
+	ConfiguredBackupSoc     float64 `json:"configured_backup_soc"`
+	AdjustedBackupSoc       float64 `json:"adjusted_backup_soc"`
+	AggSoc                  float64 `json:"agg_soc"`
+	MaxEnergy               float64 `json:"Max_energy"`
+	EncAggSoc               float64 `json:"ENC_agg_soc"`
+	EncAggSoh               float64 `json:"ENC_agg_soh"`
+	EncAggBackupEnergy      float64 `json:"ENC_agg_backup_energy"`
+	EncAggAvailEnergy       float64 `json:"ENC_agg_avail_energy"`
+	EncCommissionedCapacity float64 `json:"Enc_commissioned_capacity"`
+	EncMaxAvailableCapacity float64 `json:"Enc_max_available_capacity"`
+	AcbAggSoc               float64 `json:"ACB_agg_soc"`
+	AcbAggEnergy            float64 `json:"ACB_agg_energy"`
+}
+
+// EnsembleRelay is the state of the grid-tie relay of the Enpower
+// http://envoy.local/ivp/ensemble/relay
+type EnsembleRelay struct {
+	MainsAdminState string `json:"mains_admin_state"`
+	MainsOperState  string `json:"mains_oper_state"`
+	Der1State       int    `json:"der1_state"`
+	Der2State       int    `json:"der2_state"`
+	Der3State       int    `json:"der3_state"`
+	EnchgGridMode   string `json:"Enchg_grid_mode"`
+	SolarGridMode   string `json:"Solar_grid_mode"`
+}
+
+// OnGrid returns true when the relay connects the site to the grid
+func (r *EnsembleRelay) OnGrid() bool {
+	return r.MainsOperState == "closed"
+}
+
+// Battery is the state of one IQ Battery
+type Battery struct {
+	Serial        string  `json:"serial"`
+	PartNum       string  `json:"part_num"`
+	Soc           float64 `json:"soc"`
+	PowerW        float64 `json:"power_w"`
+	CapacityWh    float64 `json:"capacity_wh"`
+	Temperature   float64 `json:"temperature"`
+	Status        string  `json:"status"`
+	Operating     bool    `json:"operating"`
+	Communicating bool    `json:"communicating"`
+}
+
+// Enpower is the state of the system controller
+type Enpower struct {
+	Serial          string  `json:"serial"`
+	Temperature     float64 `json:"temperature"`
+	Communicating   bool    `json:"communicating"`
+	MainsAdminState string  `json:"mains_admin_state"`
+	MainsOperState  string  `json:"mains_oper_state"`
+	GridMode        string  `json:"grid_mode"`
+}
+
+// BatteryStatus gathers the ensemble endpoints. PowerW is positive when the
+// batteries discharge. Batteries is empty and Enpower nil on sites without
+// them.
+type BatteryStatus struct {
+	Batteries         []Battery `json:"batteries"`
+	Soc               float64   `json:"soc"`
+	PowerW            float64   `json:"power_w"`
+	AvailableEnergyWh float64   `json:"available_energy_wh"`
+	MaxEnergyWh       float64   `json:"max_energy_wh"`
+	OnGrid            bool      `json:"on_grid"`
+	GridMode          string    `json:"grid_mode,omitempty"`
+	Enpower           *Enpower  `json:"enpower,omitempty"`
+}
+
+// Meter is the configuration of a CT meter
+// http://envoy.local/ivp/meters
+type Meter struct {
+	EID             int64    `json:"eid"`
+	State           string   `json:"state"`
+	MeasurementType string   `json:"measurementType"`
+	PhaseMode       string   `json:"phaseMode"`
+	PhaseCount      int      `json:"phaseCount"`
+	MeteringStatus  string   `json:"meteringStatus"`
+	StatusFlags     []string `json:"statusFlags"`
+}
+
+// MeterChannel holds the values of one phase of a meter. The energies are
+// lifetime counters in Wh. On the net-consumption meter ActEnergyDlvd is the
+// energy imported from the grid and ActEnergyRcvd the energy exported to it.
+type MeterChannel struct {
+	EID                 int64   `json:"eid"`
+	Timestamp           int64   `json:"timestamp"`
+	ActEnergyDlvd       float64 `json:"actEnergyDlvd"`
+	ActEnergyRcvd       float64 `json:"actEnergyRcvd"`
+	ApparentEnergy      float64 `json:"apparentEnergy"`
+	ReactEnergyLagg     float64 `json:"reactEnergyLagg"`
+	ReactEnergyLead     float64 `json:"reactEnergyLead"`
+	InstantaneousDemand float64 `json:"instantaneousDemand"`
+	ActivePower         float64 `json:"activePower"`
+	ApparentPower       float64 `json:"apparentPower"`
+	ReactivePower       float64 `json:"reactivePower"`
+	PwrFactor           float64 `json:"pwrFactor"`
+	Voltage             float64 `json:"voltage"`
+	Current             float64 `json:"current"`
+	Freq                float64 `json:"freq"`
+}
+
+// MeterReading holds the values of a meter, summed over its phases, and of
+// each phase in Channels
+// http://envoy.local/ivp/meters/readings
+type MeterReading struct {
+	MeterChannel
+	Channels []MeterChannel `json:"channels"`
+}
+
+// LiveData is the live state of the site. The meters are only updated while
+// the live stream is enabled, see Envoy.LiveData.
+// http://envoy.local/ivp/livedata/status
+type LiveData struct {
+	Connection LiveDataConnection `json:"connection"`
+	Meters     LiveDataMeters     `json:"meters"`
+}
+
+// Streaming returns true if the gateway updates the meters
+func (d *LiveData) Streaming() bool {
+	return d.Connection.ScStream == "enabled"
+}
+
+type LiveDataConnection struct {
+	MqttState string `json:"mqtt_state"`
+	ProvState string `json:"prov_state"`
+	AuthState string `json:"auth_state"`
+	ScStream  string `json:"sc_stream"`
+	ScDebug   string `json:"sc_debug"`
+}
+
+// LiveDataMeters holds the power flows of the site. The battery values are 0
+// on sites without batteries.
+type LiveDataMeters struct {
+	LastUpdate     int64         `json:"last_update"`
+	Soc            float64       `json:"soc"`
+	MainRelayState int           `json:"main_relay_state"`
+	GenRelayState  int           `json:"gen_relay_state"`
+	BackupBatMode  int           `json:"backup_bat_mode"`
+	BackupSoc      float64       `json:"backup_soc"`
+	IsSplitPhase   int           `json:"is_split_phase"`
+	PhaseCount     int           `json:"phase_count"`
+	EncAggSoc      float64       `json:"enc_agg_soc"`
+	EncAggEnergy   float64       `json:"enc_agg_energy"`
+	AcbAggSoc      float64       `json:"acb_agg_soc"`
+	AcbAggEnergy   float64       `json:"acb_agg_energy"`
+	Pv             LiveDataPower `json:"pv"`
+	Storage        LiveDataPower `json:"storage"`
+	Grid           LiveDataPower `json:"grid"`
+	Load           LiveDataPower `json:"load"`
+	Generator      LiveDataPower `json:"generator"`
+}
+
+// LiveDataPower is the power of one flow in mW and mVA, in total and per
+// phase. Grid is positive when importing, storage when discharging.
+type LiveDataPower struct {
+	AggPMw     float64 `json:"agg_p_mw"`
+	AggSMva    float64 `json:"agg_s_mva"`
+	AggPPhAMw  float64 `json:"agg_p_ph_a_mw"`
+	AggPPhBMw  float64 `json:"agg_p_ph_b_mw"`
+	AggPPhCMw  float64 `json:"agg_p_ph_c_mw"`
+	AggSPhAMva float64 `json:"agg_s_ph_a_mva"`
+	AggSPhBMva float64 `json:"agg_s_ph_b_mva"`
+	AggSPhCMva float64 `json:"agg_s_ph_c_mva"`
+}
+
+// Power returns the active power in W
+func (p *LiveDataPower) Power() float64 {
+	return p.AggPMw / 1000
+}
+
+// PhasePower returns the active power of each phase in W
+func (p *LiveDataPower) PhasePower() [3]float64 {
+	return [3]float64{p.AggPPhAMw / 1000, p.AggPPhBMw / 1000, p.AggPPhCMw / 1000}
+}
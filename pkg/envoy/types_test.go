@@ -0,0 +1,44 @@
+package envoy
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestEntryHas(t *testing.T) {
+	var p Production
+	err := json.Unmarshal([]byte(`{"production":[
+		{"type":"inverters","activeCount":10,"readingTime":1690000000,"wNow":0,"whLifetime":1000},
+		{"type":"eim","measurementType":"production","wNow":120,"whToday":500,"whLifetime":2000}
+	]}`), &p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		entry int
+		field string
+		want  bool
+	}{
+		{0, "wNow", true},
+		{0, "whLifetime", true},
+		{0, "whToday", false},
+		{0, "rmsVoltage", false},
+		{1, "whToday", true},
+		{1, "activeCount", false},
+	}
+
+	for _, tt := range tests {
+		if got := p.Production[tt.entry].Has(tt.field); got != tt.want {
+			t.Errorf("entry %d has %s = %v, want %v", tt.entry, tt.field, got, tt.want)
+		}
+	}
+
+	if p.Production[1].WNow != 120 || p.Production[0].ActiveCount != 10 {
+		t.Errorf("values not decoded: %+v", p.Production)
+	}
+
+	if e := (Entry{}); !e.Has("whToday") {
+		t.Error("entry not decoded from json is missing fields")
+	}
+}
@@ -0,0 +1,44 @@
+// Keep the widgets up to date with the events pushed by the server
+
+function findEntry(list, type) {
+	return (list || []).find(function (e) { return e.measurementType === type; });
+}
+
+function setValue(id, v) {
+	var el = document.getElementById(id);
+	if (el && v !== undefined) {
+		el.textContent = Math.round(v);
+	}
+}
+
+function updateProduction(p) {
+	var prod = findEntry(p.production, "production") || {};
+	var conso = findEntry(p.consumption, "total-consumption") || {};
+	var net = findEntry(p.consumption, "net-consumption") || {};
+
+	setValue("prod_now", prod.wNow || 0);
+	setValue("conso_now", conso.wNow || 0);
+	setValue("net_now", net.wNow || 0);
+
+	setValue("prod_today", (prod.whToday || 0) / 1000);
+	setValue("conso_today", (conso.whToday || 0) / 1000);
+	setValue("net_today", (net.whToday || 0) / 1000);
+}
+
+function connectEvents() {
+	if (!window.EventSource) {
+		return;
+	}
+
+	var gateway = document.body.dataset.gateway || "";
+	var source = new EventSource("api/events?gateway=" + encodeURIComponent(gateway));
+
+	source.onmessage = function (msg) {
+		var ev = JSON.parse(msg.data);
+		if (ev.type === "production" && ev.data) {
+			updateProduction(ev.data);
+		}
+	};
+}
+
+document.addEventListener("DOMContentLoaded", connectEvents);